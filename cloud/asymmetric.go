@@ -0,0 +1,239 @@
+package cloud
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers crypto.SHA512 for RSA_DECRYPT_OAEP_4096_SHA512 keys
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// gcpAsymmetricScheme is the key URI scheme of GCP asymmetric decryption keys. Cloud KMS
+// also accepts symmetric keys by version, so asymmetric keys are told apart by scheme.
+// eg: gcpkms-rsa://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-rsa/cryptoKeyVersions/1
+const gcpAsymmetricScheme = "gcpkms-rsa"
+
+// gcpKeyVersionSegment appears in GCP resource names that address a single key version.
+// Asymmetric keys can only be used by version.
+const gcpKeyVersionSegment = "/cryptoKeyVersions/"
+
+// GCPAsymmetricKMS is a client for GCP KMS asymmetric decryption keys (RSA-OAEP).
+// Encryption only requires the public key, which is fetched once and cached on disk, so
+// principals who may view the public key but not decrypt can still add secrets, and can
+// do so offline once the key is cached. Decryption is performed by the KMS.
+type GCPAsymmetricKMS struct {
+	GCPKMS
+
+	// the public key is loaded on first use from the cache, or the KMS
+	pubMu     sync.Mutex
+	publicKey *rsa.PublicKey
+	hash      crypto.Hash
+}
+
+// cachedPublicKey is the on disk representation of a cached public key.
+type cachedPublicKey struct {
+	Pem       string `json:"pem"`
+	Algorithm string `json:"algorithm"`
+}
+
+// Encrypt seals plaintext locally with the public key of the key version using RSA-OAEP.
+// The plaintext is limited by the size of the key, which comfortably fits a data key.
+func (akms *GCPAsymmetricKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	pub, hash, err := akms.loadPublicKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := rsa.EncryptOAEP(hash.New(), rand.Reader, pub, plaintext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with key %s: %w", akms.keyname, err)
+	}
+	return ciphertext, nil
+}
+
+// EncryptVersion is Encrypt. Asymmetric keys are pinned to a key version, which is always
+// the version used.
+func (akms *GCPAsymmetricKMS) EncryptVersion(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	ciphertext, err := akms.Encrypt(ctx, plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+	return ciphertext, akms.keyname, nil
+}
+
+// EncryptsWithPublicKey is always true, as Encrypt only needs the public key.
+func (akms *GCPAsymmetricKMS) EncryptsWithPublicKey() bool {
+	return true
+}
+
+// PrimaryVersion returns the pinned key version.
+func (akms *GCPAsymmetricKMS) PrimaryVersion(ctx context.Context) (string, error) {
+	return akms.keyname, nil
+}
+
+// Decrypt invokes the GCP KMS API to decrypt ciphertext with the private half of the key.
+func (akms *GCPAsymmetricKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	client, err := akms.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &kmspb.AsymmetricDecryptRequest{
+		Name:       akms.keyname,
+		Ciphertext: ciphertext,
+	}
+	var resp *kmspb.AsymmetricDecryptResponse
+	err = withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		resp, err = client.AsymmetricDecrypt(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s: %w", akms.keyname, err)
+	}
+	return resp.Plaintext, nil
+}
+
+// loadPublicKey returns the public key of the key version, consulting the on disk cache
+// before the KMS. Keys fetched from the KMS are written back to the cache.
+func (akms *GCPAsymmetricKMS) loadPublicKey(ctx context.Context) (*rsa.PublicKey, crypto.Hash, error) {
+	akms.pubMu.Lock()
+	defer akms.pubMu.Unlock()
+	if akms.publicKey != nil {
+		return akms.publicKey, akms.hash, nil
+	}
+
+	cachePath, err := publicKeyCachePath(akms.keyname)
+	if err != nil {
+		log.Debugf("public key cache unavailable: %v", err)
+	}
+
+	var cached cachedPublicKey
+	if data, err := os.ReadFile(cachePath); err == nil && json.Unmarshal(data, &cached) == nil {
+		log.Debugf("Using cached public key for %s", akms.keyname)
+	} else {
+		cached, err = akms.fetchPublicKey(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		if cachePath != "" {
+			if err := writePublicKeyCache(cachePath, cached); err != nil {
+				log.Debugf("failed to cache public key: %v", err)
+			}
+		}
+	}
+
+	pub, hash, err := parsePublicKey(cached)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid public key for %s: %w", akms.keyname, err)
+	}
+	akms.publicKey, akms.hash = pub, hash
+	return pub, hash, nil
+}
+
+// fetchPublicKey retrieves the public key of the key version from the KMS, verifying the
+// checksum of the response.
+func (akms *GCPAsymmetricKMS) fetchPublicKey(ctx context.Context) (cachedPublicKey, error) {
+	client, err := akms.client(ctx)
+	if err != nil {
+		return cachedPublicKey{}, err
+	}
+
+	req := &kmspb.GetPublicKeyRequest{
+		Name: akms.keyname,
+	}
+	var resp *kmspb.PublicKey
+	err = withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		resp, err = client.GetPublicKey(ctx, req)
+		return err
+	})
+	if err != nil {
+		return cachedPublicKey{}, fmt.Errorf("failed to fetch public key %s: %w", akms.keyname, err)
+	}
+	if resp.PemCrc32C != nil && int64(crc32.Checksum([]byte(resp.Pem), crc32.MakeTable(crc32.Castagnoli))) != resp.PemCrc32C.Value {
+		return cachedPublicKey{}, fmt.Errorf("public key %s was corrupted in transit", akms.keyname)
+	}
+	return cachedPublicKey{
+		Pem:       resp.Pem,
+		Algorithm: resp.Algorithm.String(),
+	}, nil
+}
+
+// parsePublicKey decodes a PEM encoded RSA public key, and selects the OAEP hash declared
+// by its key version algorithm.
+func parsePublicKey(cached cachedPublicKey) (*rsa.PublicKey, crypto.Hash, error) {
+	if !strings.HasPrefix(cached.Algorithm, "RSA_DECRYPT_OAEP_") {
+		return nil, 0, fmt.Errorf("algorithm %s is not an RSA-OAEP decryption key", cached.Algorithm)
+	}
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(cached.Algorithm, "_SHA256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(cached.Algorithm, "_SHA512"):
+		hash = crypto.SHA512
+	default:
+		return nil, 0, fmt.Errorf("unsupported algorithm %s", cached.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(cached.Pem))
+	if block == nil {
+		return nil, 0, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, 0, errors.New("not an RSA public key")
+	}
+	return pub, hash, nil
+}
+
+// publicKeyCachePath returns the file caching the public key of a key version, under the
+// user's cache directory. eg: ~/.cache/sctl/publickeys/
+func publicKeyCachePath(keyname string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(keyname))
+	return filepath.Join(cacheDir, "sctl", "publickeys", hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// writePublicKeyCache stores a public key at path, creating the cache directory if needed.
+func writePublicKeyCache(path string, cached cachedPublicKey) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// NewGCPAsymmetricKMS creates a new KMS client for a GCP asymmetric decryption key version,
+// dialed like NewGCPKMS.
+func NewGCPAsymmetricKMS(keyname string, opts ...option.ClientOption) KMS {
+	return &GCPAsymmetricKMS{
+		GCPKMS: GCPKMS{
+			keyname: keyname,
+			opts:    opts,
+		},
+	}
+}
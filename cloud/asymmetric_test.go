@@ -0,0 +1,117 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAsymmetricKey = "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-rsa/cryptoKeyVersions/1"
+
+// Point the user cache directory at a temporary path, and prime it with the public half
+// of a freshly generated key for testAsymmetricKey.
+func testPublicKeyCache(t *testing.T, algorithm string) *rsa.PrivateKey {
+	tempPath, err := os.MkdirTemp("", t.Name())
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tempPath) })
+	t.Setenv("XDG_CACHE_HOME", tempPath)
+	t.Setenv("HOME", tempPath)
+	t.Setenv("LocalAppData", tempPath)
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.NoError(t, err)
+
+	cachePath, err := publicKeyCachePath(testAsymmetricKey)
+	assert.NoError(t, err)
+	err = writePublicKeyCache(cachePath, cachedPublicKey{
+		Pem:       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Algorithm: algorithm,
+	})
+	assert.NoError(t, err)
+	return priv
+}
+
+func TestNewKMSAsymmetric(t *testing.T) {
+	client, err := NewKMS("gcpkms-rsa://" + testAsymmetricKey)
+	assert.NoError(t, err)
+	assert.IsType(t, &GCPAsymmetricKMS{}, client)
+	assert.Equal(t, testAsymmetricKey, client.(*GCPAsymmetricKMS).keyname)
+	assert.Implements(t, (*PublicKeyEncrypter)(nil), client)
+
+	// Symmetric keys may be pinned to a version too
+	for _, uri := range []string{testAsymmetricKey, "gcpkms://" + testAsymmetricKey} {
+		client, err = NewKMS(uri)
+		assert.NoError(t, err)
+		assert.IsType(t, &GCPKMS{}, client)
+		_, public := client.(PublicKeyEncrypter)
+		assert.False(t, public)
+	}
+
+	_, err = NewKMS("gcpkms-rsa://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-rsa")
+	assert.Error(t, err)
+}
+
+// With the public key cached, encryption needs neither credentials nor the network.
+func TestGCPAsymmetricKMSEncryptOffline(t *testing.T) {
+	priv := testPublicKeyCache(t, "RSA_DECRYPT_OAEP_2048_SHA256")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/does/not/exist.json")
+
+	client := NewGCPAsymmetricKMS(testAsymmetricKey)
+	defer client.Close()
+
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	decrypted, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, cypher, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	// Data keys are sealed the same way
+	_, wrappedKey, err := Seal(context.Background(), client, []byte("hello"), nil)
+	assert.NoError(t, err)
+	dek, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrappedKey, nil)
+	assert.NoError(t, err)
+	assert.Len(t, dek, dataKeySize)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.NoError(t, err)
+	validPem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	var testTable = []struct {
+		name      string
+		pem       string
+		algorithm string
+		valid     bool
+	}{
+		{"SHA256", validPem, "RSA_DECRYPT_OAEP_3072_SHA256", true},
+		{"SHA512", validPem, "RSA_DECRYPT_OAEP_4096_SHA512", true},
+		{"Signing Key", validPem, "RSA_SIGN_PSS_2048_SHA256", false},
+		{"Symmetric Key", validPem, "GOOGLE_SYMMETRIC_ENCRYPTION", false},
+		{"Bad PEM", "not a key", "RSA_DECRYPT_OAEP_2048_SHA256", false},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, _, err := parsePublicKey(cachedPublicKey{Pem: tt.pem, Algorithm: tt.algorithm})
+			if tt.valid {
+				assert.NoError(t, err)
+				assert.Equal(t, &priv.PublicKey, pub)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
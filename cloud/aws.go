@@ -0,0 +1,121 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// AWSEndpointVar overrides the AWS KMS endpoint, which is useful when pointing sctl at a
+// KMS compatible stand-in such as local-kms.
+const AWSEndpointVar = "AWS_KMS_ENDPOINT"
+
+// AWSKMS is an Amazon Web Services KMS client.
+// Credentials and region are resolved with the standard AWS credential chain
+// (environment, shared config/credentials files, SSO, instance roles).
+type AWSKMS struct {
+	// property keyID - the ARN or alias of the AWS KMS key
+	// eg: arn:aws:kms:us-east-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab
+	// eg: alias/sctl-dev
+
+	keyID string
+
+	// the client is configured on first use, and shared by every subsequent call
+	mu        sync.Mutex
+	kmsClient *kms.Client
+}
+
+// Construct and return an AWS KMS client from the default credential chain. The client is
+// created once and cached for the lifetime of the AWSKMS.
+func (akms *AWSKMS) client(ctx context.Context) (*kms.Client, error) {
+	akms.mu.Lock()
+	defer akms.mu.Unlock()
+	if akms.kmsClient != nil {
+		return akms.kmsClient, nil
+	}
+
+	var opts []func(*config.LoadOptions) error
+	// Key ARNs carry their region, which takes precedence over the configured default
+	// as the key can only be used in the region it lives in.
+	if region := akms.region(); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	akms.kmsClient = kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if endpoint := os.Getenv(AWSEndpointVar); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return akms.kmsClient, nil
+}
+
+// Close discards the cached client. The AWS SDK pools its HTTP connections, so there is
+// nothing to tear down beyond letting the client be collected.
+func (akms *AWSKMS) Close() error {
+	akms.mu.Lock()
+	defer akms.mu.Unlock()
+	akms.kmsClient = nil
+	return nil
+}
+
+// region extracts the region from a key ARN, eg: arn:aws:kms:REGION:ACCOUNT:key/ID.
+// Returns an empty string for aliases and bare key IDs.
+func (akms *AWSKMS) region() string {
+	parts := strings.Split(akms.keyID, ":")
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
+
+// Encrypt invokes AWS KMS to encrypt the data. Returns the ciphertext blob.
+// The AWS SDK retries transient failures itself, within the bounds of ctx.
+func (akms *AWSKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	client, err := akms.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(akms.keyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with key %s: %w", akms.keyID, err)
+	}
+	return resp.CiphertextBlob, nil
+}
+
+// Decrypt invokes AWS KMS to decrypt the ciphertext blob. The key is always declared so
+// that KMS refuses ciphertext sealed under any other key.
+func (akms *AWSKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	client, err := akms.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(akms.keyID),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s: %w", akms.keyID, err)
+	}
+	return resp.Plaintext, nil
+}
+
+// NewAWSKMS creates a new KMS client for Amazon Web Services.
+func NewAWSKMS(keyID string) KMS {
+	return &AWSKMS{
+		keyID: keyID,
+	}
+}
@@ -0,0 +1,118 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAWSKey = "arn:aws:kms:us-east-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+// newTestTrentService stands up a minimal imitation of the AWS KMS JSON API. Ciphertext
+// blobs are the plaintext prefixed with the key ID, which is enough to check the wire
+// protocol and that the key is declared on decrypt.
+func newTestTrentService(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			KeyID          string `json:"KeyId"`
+			Plaintext      []byte `json:"Plaintext"`
+			CiphertextBlob []byte `json:"CiphertextBlob"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+		assert.Contains(t, r.Header.Get("Authorization"), "us-east-2/kms/aws4_request")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId":          body.KeyID,
+				"CiphertextBlob": append([]byte(body.KeyID+":"), body.Plaintext...),
+			})
+		case "TrentService.Decrypt":
+			if !strings.HasPrefix(string(body.CiphertextBlob), body.KeyID+":") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"IncorrectKeyException","message":"The key ID in the request does not identify a CMK that can perform this operation."}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId":     body.KeyID,
+				"Plaintext": []byte(strings.TrimPrefix(string(body.CiphertextBlob), body.KeyID+":")),
+			})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"UnknownOperationException"}`))
+		}
+	}))
+}
+
+// Isolate the AWS credential chain from the host, and point it at the stand-in server.
+func testAWSEnv(t *testing.T, endpoint string) {
+	tempPath, err := os.MkdirTemp("", t.Name())
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tempPath) })
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(tempPath, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(tempPath, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv(AWSEndpointVar, endpoint)
+}
+
+func TestAWSKMSRegion(t *testing.T) {
+	var testTable = []struct {
+		name   string
+		keyID  string
+		region string
+	}{
+		{"Key ARN", testAWSKey, "us-east-2"},
+		{"Alias ARN", "arn:aws:kms:ap-south-1:111122223333:alias/sctl", "ap-south-1"},
+		{"Alias", "alias/sctl", ""},
+		{"Key ID", "1234abcd-12ab-34cd-56ef-1234567890ab", ""},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewAWSKMS(tt.keyID).(*AWSKMS)
+			assert.Equal(t, tt.region, client.region())
+		})
+	}
+}
+
+func TestAWSKMSEncryptDecrypt(t *testing.T) {
+	server := newTestTrentService(t)
+	defer server.Close()
+	testAWSEnv(t, server.URL)
+
+	client, err := NewKMS("awskms://" + testAWSKey)
+	assert.NoError(t, err)
+
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, testAWSKey+":hello", string(cypher))
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
+
+func TestAWSKMSDecryptWrongKey(t *testing.T) {
+	server := newTestTrentService(t)
+	defer server.Close()
+	testAWSEnv(t, server.URL)
+
+	cypher, err := NewAWSKMS(testAWSKey).Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	_, err = NewAWSKMS("arn:aws:kms:us-east-2:111122223333:key/other").Decrypt(context.Background(), cypher)
+	assert.Error(t, err)
+}
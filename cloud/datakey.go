@@ -0,0 +1,137 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dataKeySize is the size in bytes of a generated data encryption key (AES-256).
+const dataKeySize = 32
+
+// ErrUnauthenticated is returned by Open when the data key was unwrapped, but the
+// ciphertext or its additional authenticated data did not verify. This indicates the
+// ciphertext was tampered with, or was sealed for a different purpose.
+var ErrUnauthenticated = errors.New("ciphertext failed authentication")
+
+// Seal encrypts plaintext locally under a freshly generated data encryption key (DEK)
+// with AES-GCM, and wraps the DEK with the KMS. Only the 32 byte DEK is sent to the
+// KMS, so the plaintext is not subject to KMS payload size limits.
+// The additional authenticated data aad is bound to the ciphertext, and the same aad must
+// be presented to Open. It may be nil.
+// Returns the ciphertext and the wrapped DEK, both of which are needed to Open.
+func Seal(ctx context.Context, kms KMS, plaintext []byte, aad []byte) ([]byte, []byte, error) {
+	ciphertext, wrappedKeys, _, err := SealAll(ctx, []KMS{kms}, plaintext, aad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ciphertext, wrappedKeys[0], nil
+}
+
+// SealAll is Seal for several recipients. The DEK is wrapped by every KMS, and any one
+// of the wrapped keys is enough to Open the ciphertext. The wrapped keys are returned in
+// the same order as the KMS clients, along with the key versions that wrapped them as
+// returned by WrapAll.
+func SealAll(ctx context.Context, kmses []KMS, plaintext []byte, aad []byte) ([]byte, [][]byte, []string, error) {
+	dek := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, nil, err
+	}
+
+	ciphertext, err := sealAESGCM(dek, plaintext, aad)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wrappedKeys, versions, err := WrapAll(ctx, kmses, dek)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ciphertext, wrappedKeys, versions, nil
+}
+
+// Open unwraps the DEK with the KMS and uses it to decrypt ciphertext produced by Seal.
+// Returns ErrUnauthenticated if the ciphertext was not sealed with the same aad.
+func Open(ctx context.Context, kms KMS, ciphertext []byte, wrappedKey []byte, aad []byte) ([]byte, error) {
+	return OpenAny(ctx, []KMS{kms}, ciphertext, [][]byte{wrappedKey}, aad)
+}
+
+// OpenAny is Open for ciphertext sealed by SealAll. The wrapped keys are tried in order
+// with the KMS client at the same position until one unwraps the DEK.
+func OpenAny(ctx context.Context, kmses []KMS, ciphertext []byte, wrappedKeys [][]byte, aad []byte) ([]byte, error) {
+	dek, err := UnwrapAny(ctx, kmses, wrappedKeys)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openAESGCM(dek, ciphertext, aad)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return plaintext, nil
+}
+
+// Rewrap unwraps a DEK with one KMS and wraps it with another, leaving the data it
+// protects untouched. This makes re-keying independent of the size of the secret.
+func Rewrap(ctx context.Context, from KMS, to KMS, wrappedKey []byte) ([]byte, error) {
+	dek, err := from.Decrypt(ctx, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return to.Encrypt(ctx, dek)
+}
+
+// WrapAll wraps a DEK with every KMS, returning the wrapped keys in the same order. The
+// name of the key version each KMS wrapped with is returned alongside, or an empty string
+// for KMS clients that are not a KeyVersioner.
+func WrapAll(ctx context.Context, kmses []KMS, dek []byte) ([][]byte, []string, error) {
+	wrappedKeys := make([][]byte, len(kmses))
+	versions := make([]string, len(kmses))
+	for i, kms := range kmses {
+		var err error
+		if versioner, ok := kms.(KeyVersioner); ok {
+			wrappedKeys[i], versions[i], err = versioner.EncryptVersion(ctx, dek)
+		} else {
+			wrappedKeys[i], err = kms.Encrypt(ctx, dek)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return wrappedKeys, versions, nil
+}
+
+// UnwrapAny tries each wrapped key in order with the KMS client at the same position,
+// returning the first DEK to be unwrapped. Empty wrapped keys are skipped. When every
+// attempt fails, the errors of all attempts are returned.
+func UnwrapAny(ctx context.Context, kmses []KMS, wrappedKeys [][]byte) ([]byte, error) {
+	if len(kmses) != len(wrappedKeys) {
+		return nil, fmt.Errorf("have %d KMS clients for %d wrapped keys", len(kmses), len(wrappedKeys))
+	}
+	var failures []error
+	for i, kms := range kmses {
+		if len(wrappedKeys[i]) == 0 {
+			continue
+		}
+		dek, err := kms.Decrypt(ctx, wrappedKeys[i])
+		if err == nil {
+			return dek, nil
+		}
+		failures = append(failures, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(failures) == 0 {
+		return nil, errors.New("no wrapped data key to unwrap")
+	}
+	if len(failures) == 1 {
+		return nil, failures[0]
+	}
+	messages := make([]string, len(failures))
+	for i, err := range failures {
+		messages[i] = err.Error()
+	}
+	return nil, fmt.Errorf("unable to unwrap data key with any recipient: %s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,122 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpen(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+	client := NewLocalKMS(keyfile)
+
+	// Well beyond the 64KiB limit imposed by Cloud KMS on plaintext
+	plaintext := bytes.Repeat([]byte("sctl"), 64*1024)
+
+	ciphertext, wrappedKey, err := Seal(context.Background(), client, plaintext, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, plaintext, ciphertext)
+
+	opened, err := Open(context.Background(), client, ciphertext, wrappedKey, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+
+	// The ciphertext can not be opened with the wrong wrapped key
+	_, otherKey, err := Seal(context.Background(), client, plaintext, nil)
+	assert.NoError(t, err)
+	_, err = Open(context.Background(), client, ciphertext, otherKey, nil)
+	assert.Error(t, err)
+}
+
+func TestRewrap(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+	newKeyfile := filepath.Join(tempPath, "new.key")
+	err := GenerateLocalKey(newKeyfile)
+	assert.NoError(t, err)
+
+	oldClient := NewLocalKMS(keyfile)
+	newClient := NewLocalKMS(newKeyfile)
+
+	ciphertext, wrappedKey, err := Seal(context.Background(), oldClient, []byte("hello"), nil)
+	assert.NoError(t, err)
+
+	rewrapped, err := Rewrap(context.Background(), oldClient, newClient, wrappedKey)
+	assert.NoError(t, err)
+
+	opened, err := Open(context.Background(), newClient, ciphertext, rewrapped, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), opened)
+
+	_, err = Open(context.Background(), oldClient, ciphertext, rewrapped, nil)
+	assert.Error(t, err)
+}
+
+func TestSealOpenAAD(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+	client := NewLocalKMS(keyfile)
+
+	ciphertext, wrappedKey, err := Seal(context.Background(), client, []byte("hello"), []byte("DB_PASSWORD"))
+	assert.NoError(t, err)
+
+	opened, err := Open(context.Background(), client, ciphertext, wrappedKey, []byte("DB_PASSWORD"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), opened)
+
+	var testTable = []struct {
+		name string
+		aad  []byte
+	}{
+		{"Different AAD", []byte("ADMIN_TOKEN")},
+		{"Missing AAD", nil},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Open(context.Background(), client, ciphertext, wrappedKey, tt.aad)
+			assert.Equal(t, ErrUnauthenticated, err)
+		})
+	}
+}
+
+func TestSealAllOpenAny(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+	otherKeyfile := filepath.Join(tempPath, "other.key")
+	err := GenerateLocalKey(otherKeyfile)
+	assert.NoError(t, err)
+
+	primary := NewLocalKMS(keyfile)
+	recipient := NewLocalKMS(otherKeyfile)
+	lost := NewLocalKMS(filepath.Join(tempPath, "lost.key"))
+
+	ciphertext, wrappedKeys, versions, err := SealAll(context.Background(), []KMS{primary, recipient}, []byte("hello"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, wrappedKeys, 2)
+	// Local keys are not versioned
+	assert.Equal(t, []string{"", ""}, versions)
+
+	// The recipient opens the ciphertext when the primary key is lost
+	opened, err := OpenAny(context.Background(), []KMS{lost, recipient}, ciphertext, wrappedKeys, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), opened)
+
+	// Recipients the secret was not sealed for are skipped
+	opened, err = OpenAny(context.Background(), []KMS{primary, recipient}, ciphertext, [][]byte{nil, wrappedKeys[1]}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), opened)
+
+	// Every failure is reported
+	_, err = OpenAny(context.Background(), []KMS{lost, lost}, ciphertext, wrappedKeys, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to unwrap data key with any recipient")
+
+	_, err = UnwrapAny(context.Background(), []KMS{primary}, [][]byte{nil})
+	assert.EqualError(t, err, "no wrapped data key to unwrap")
+}
@@ -0,0 +1,130 @@
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/cloud/kmstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testGCPKey           = "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"
+	testGCPAsymmetricKey = "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-rsa/cryptoKeyVersions/1"
+)
+
+func TestGCPKMSEncryptDecrypt(t *testing.T) {
+	server := kmstest.Start(t)
+
+	client, err := cloud.NewKMS(testGCPKey)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	// Ciphertext from another key is refused
+	other := cloud.NewGCPKMS(testGCPKey+"-other", server.ClientOptions()...)
+	defer other.Close()
+	_, err = other.Decrypt(context.Background(), cypher)
+	assert.Equal(t, codes.InvalidArgument, status.Code(errors.Unwrap(err)))
+
+	// Symmetric keys pinned to a version are used with Encrypt and Decrypt too
+	pinned, err := cloud.NewKMS("gcpkms://" + testGCPKey + "/cryptoKeyVersions/1")
+	assert.NoError(t, err)
+	defer pinned.Close()
+	cypher, err = pinned.Encrypt(context.Background(), []byte("pinned"))
+	assert.NoError(t, err)
+	decrypted, err = client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("pinned"), decrypted)
+}
+
+func TestGCPKMSKeyVersions(t *testing.T) {
+	server := kmstest.Start(t)
+	ctx := context.Background()
+	client := cloud.NewGCPKMS(testGCPKey, server.ClientOptions()...).(cloud.KeyVersioner)
+	defer client.(cloud.KMS).Close()
+
+	primary, err := client.PrimaryVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, testGCPKey+"/cryptoKeyVersions/1", primary)
+	cypher, version, err := client.EncryptVersion(ctx, []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, primary, version)
+
+	// Rotation moves new ciphertext to the new primary version
+	rotated := server.RotateKey(testGCPKey)
+	assert.Equal(t, testGCPKey+"/cryptoKeyVersions/2", rotated)
+	primary, err = client.PrimaryVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated, primary)
+	_, version, err = client.EncryptVersion(ctx, []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, rotated, version)
+
+	// Ciphertext on the old version still decrypts
+	decrypted, err := client.(cloud.KMS).Decrypt(ctx, cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
+
+func TestGCPKMSRetries(t *testing.T) {
+	server := kmstest.Start(t)
+	client := cloud.NewGCPKMS(testGCPKey, server.ClientOptions()...)
+	defer client.Close()
+
+	// Transient failures are retried
+	server.FailNext(codes.Unavailable, 2)
+	_, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	// Permanent failures are not, and name the key
+	server.FailNext(codes.PermissionDenied, 1)
+	_, err = client.Encrypt(context.Background(), []byte("hello"))
+	assert.EqualError(t, err, "failed to encrypt with key "+testGCPKey+": rpc error: code = PermissionDenied desc = failure injected by kmstest")
+
+	// The context bounds the retries
+	server.FailNext(codes.Unavailable, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = client.Encrypt(ctx, []byte("hello"))
+	assert.Error(t, err)
+}
+
+func TestGCPAsymmetricKMSEncryptDecrypt(t *testing.T) {
+	server := kmstest.Start(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	client, err := cloud.NewKMS("gcpkms-rsa://" + testGCPAsymmetricKey)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	// A new client encrypts from the cached public key, without the server
+	offline := cloud.NewGCPAsymmetricKMS(testGCPAsymmetricKey, append(server.ClientOptions(), option.WithEndpoint("127.0.0.1:1"))...)
+	defer offline.Close()
+	cypher, err = offline.Encrypt(context.Background(), []byte("offline"))
+	assert.NoError(t, err)
+
+	decrypted, err = client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("offline"), decrypted)
+}
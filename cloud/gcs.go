@@ -0,0 +1,167 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vapor-ware/sctl/credentials"
+	"github.com/vapor-ware/sctl/utils"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// gcsScheme is the envelope URL scheme of Cloud Storage, eg: gs://bucket/.scuttle.json
+	gcsScheme = "gs"
+	// gcsEndpoint is the Cloud Storage JSON API
+	gcsEndpoint = "https://storage.googleapis.com"
+	// gcsScope grants reading and writing objects
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+	// gcsTimeout bounds each request to Cloud Storage
+	gcsTimeout = time.Minute
+)
+
+// RegisterStateManagers makes the envelope backends of cloud providers available to
+// utils.NewEnvelopeStateManager, eg: gs://bucket/.scuttle.json
+func RegisterStateManagers() {
+	RegisterGCS("")
+}
+
+// RegisterGCS makes gs:// envelopes available to utils.NewEnvelopeStateManager, stored
+// through the Cloud Storage JSON API at endpoint, which is called without credentials, eg:
+// a stand-in such as cloud/gcstest. An empty endpoint is Cloud Storage itself, called with
+// sctl's Google credential, as RegisterStateManagers does.
+func RegisterGCS(endpoint string) {
+	utils.RegisterStateManager(gcsScheme, func(location string) (utils.EnvelopeStateManager, error) {
+		return newGCSStateManager(location, strings.TrimSuffix(endpoint, "/"))
+	})
+}
+
+// GCSStateManager stores an envelope as a Cloud Storage object. The object's generation is
+// its revision, and writes are made conditional on it with ifGenerationMatch.
+type GCSStateManager struct {
+	bucket string
+	object string
+
+	// endpoint, when set, replaces Cloud Storage, and is called without credentials
+	endpoint string
+}
+
+// NewGCSStateManager is a factory method to initialize a GCSStateManager for a
+// gs://BUCKET/OBJECT envelope URL.
+func NewGCSStateManager(location string) (utils.EnvelopeStateManager, error) {
+	return newGCSStateManager(location, "")
+}
+
+// newGCSStateManager is NewGCSStateManager, storing the envelope through endpoint when set.
+func newGCSStateManager(location string, endpoint string) (utils.EnvelopeStateManager, error) {
+	_, path := ParseKeyURI(location)
+	bucket, object, found := strings.Cut(path, "/")
+	if !found || bucket == "" || object == "" {
+		return nil, fmt.Errorf("invalid envelope URL %q - expected gs://BUCKET/OBJECT", location)
+	}
+	return GCSStateManager{bucket: bucket, object: object, endpoint: endpoint}, nil
+}
+
+// client returns an HTTP client for Cloud Storage and its endpoint, authenticated with the
+// same credential as Cloud KMS.
+func (g GCSStateManager) client(ctx context.Context) (*http.Client, string, error) {
+	if g.endpoint != "" {
+		return &http.Client{Timeout: gcsTimeout}, g.endpoint, nil
+	}
+
+	var cred credentials.GoogleCredential
+	credentialJSON, err := cred.JSON()
+	if err != nil {
+		return nil, "", err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, credentialJSON, gcsScope)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "invalid Google credential")
+	}
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client.Timeout = gcsTimeout
+	return client, gcsEndpoint, nil
+}
+
+// ReadEnvelope downloads the object, with its generation as the revision.
+func (g GCSStateManager) ReadEnvelope() ([]byte, string, error) {
+	ctx := context.Background()
+	client, endpoint, err := g.client(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Get(fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media",
+		endpoint, url.PathEscape(g.bucket), url.PathEscape(g.object)))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read envelope %s", g)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", &os.PathError{Op: "read", Path: g.String(), Err: os.ErrNotExist}
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("unexpected status reading envelope %s: %s", g, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed reading envelope %s", g)
+	}
+	return data, resp.Header.Get("X-Goog-Generation"), nil
+}
+
+// WriteEnvelope uploads the object if it is still at the generation given as revision, or
+// does not exist when revision is empty.
+func (g GCSStateManager) WriteEnvelope(data []byte, revision string) (string, error) {
+	ctx := context.Background()
+	client, endpoint, err := g.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	if revision == "" {
+		// Generation 0 matches only an object that does not exist
+		revision = "0"
+	}
+	query := url.Values{
+		"uploadType":        {"media"},
+		"name":              {g.object},
+		"ifGenerationMatch": {revision},
+	}
+	resp, err := client.Post(fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", endpoint, url.PathEscape(g.bucket), query.Encode()),
+		"application/json", bytes.NewReader(data))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to write envelope %s", g)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return "", errors.Wrapf(utils.ErrEnvelopeChanged, "not saving %s", g)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("unexpected status writing envelope %s: %s", g, resp.Status)
+	}
+	var object struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return "", errors.Wrapf(err, "invalid response writing envelope %s", g)
+	}
+	return object.Generation, nil
+}
+
+// Lock does nothing, as Cloud Storage envelopes are protected by their generation instead.
+func (g GCSStateManager) Lock() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (g GCSStateManager) String() string {
+	return gcsScheme + "://" + g.bucket + "/" + g.object
+}
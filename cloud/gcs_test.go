@@ -0,0 +1,52 @@
+package cloud_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/cloud/gcstest"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestGCSStateManager(t *testing.T) {
+	server := gcstest.Start(t)
+
+	manager, err := utils.NewEnvelopeStateManager("gs://sctl-state/team/.scuttle.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "gs://sctl-state/team/.scuttle.json", manager.String())
+
+	_, _, err = manager.ReadEnvelope()
+	assert.True(t, os.IsNotExist(err))
+
+	// Create, then update at the latest generation
+	revision, err := manager.WriteEnvelope([]byte("first"), "")
+	assert.NoError(t, err)
+	_, err = manager.WriteEnvelope([]byte("again"), "")
+	assert.ErrorIs(t, err, utils.ErrEnvelopeChanged)
+	revision, err = manager.WriteEnvelope([]byte("second"), revision)
+	assert.NoError(t, err)
+
+	data, read, err := manager.ReadEnvelope()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+	assert.Equal(t, revision, read)
+
+	// A write by someone else makes the revision stale
+	generation := server.Put("sctl-state", "team/.scuttle.json", []byte("theirs"))
+	_, err = manager.WriteEnvelope([]byte("mine"), revision)
+	assert.ErrorIs(t, err, utils.ErrEnvelopeChanged)
+	object, _ := server.Object("sctl-state", "team/.scuttle.json")
+	assert.Equal(t, []byte("theirs"), object)
+	_, err = manager.WriteEnvelope([]byte("mine"), strconv.FormatInt(generation, 10))
+	assert.NoError(t, err)
+}
+
+func TestNewGCSStateManager(t *testing.T) {
+	for _, location := range []string{"gs://", "gs://bucket", "gs://bucket/", "gs:///object"} {
+		_, err := cloud.NewGCSStateManager(location)
+		assert.Error(t, err, location)
+	}
+}
@@ -0,0 +1,155 @@
+// Package gcstest provides a local stand-in for the Cloud Storage JSON API, so envelopes
+// stored in gs:// backends can be exercised without cloud credentials.
+package gcstest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vapor-ware/sctl/cloud"
+)
+
+// Server is a local stand-in for the parts of the Cloud Storage JSON API sctl uses: media
+// downloads and uploads of objects, with generation preconditions. Every bucket exists
+// without having to be created first.
+type Server struct {
+	// URL is the base URL of the server, eg: http://127.0.0.1:1234
+	URL string
+
+	httpServer *httptest.Server
+
+	mu          sync.Mutex
+	objects     map[string][]byte
+	generations map[string]int64
+	generation  int64
+}
+
+// NewServer starts a Server listening on a random local port.
+func NewServer() *Server {
+	s := &Server{
+		objects:     map[string][]byte{},
+		generations: map[string]int64{},
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.httpServer.URL
+	return s
+}
+
+// Start starts a Server for the duration of a test, and points gs:// envelopes at it with
+// cloud.RegisterGCS.
+func Start(t testing.TB) *Server {
+	s := NewServer()
+	cloud.RegisterGCS(s.URL)
+	t.Cleanup(func() {
+		cloud.RegisterStateManagers()
+		s.Close()
+	})
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// Object returns the contents of an object, and whether it exists.
+func (s *Server) Object(bucket string, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, found := s.objects[bucket+"/"+name]
+	return data, found
+}
+
+// Put replaces an object, as another client would, returning its new generation.
+func (s *Server) Put(bucket string, name string, data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(bucket+"/"+name, data)
+}
+
+// put stores an object under a new generation. The lock must be held.
+func (s *Server) put(key string, data []byte) int64 {
+	s.generation++
+	s.objects[key] = append([]byte(nil), data...)
+	s.generations[key] = s.generation
+	return s.generation
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/storage/v1/b/"):
+		s.download(w, r, strings.TrimPrefix(path, "/storage/v1/b/"))
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		s.upload(w, r, strings.TrimPrefix(path, "/upload/storage/v1/b/"))
+	default:
+		http.Error(w, "not implemented by gcstest", http.StatusNotImplemented)
+	}
+}
+
+// download serves GET /storage/v1/b/BUCKET/o/OBJECT?alt=media
+func (s *Server) download(w http.ResponseWriter, r *http.Request, path string) {
+	bucket, object, found := strings.Cut(path, "/o/")
+	name, err := url.PathUnescape(object)
+	if !found || err != nil || r.URL.Query().Get("alt") != "media" {
+		http.Error(w, "unsupported download", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	key := bucket + "/" + name
+	data, exists := s.objects[key]
+	generation := s.generations[key]
+	s.mu.Unlock()
+	if !exists {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(generation, 10))
+	w.Write(data)
+}
+
+// upload serves POST /upload/storage/v1/b/BUCKET/o?uploadType=media&name=OBJECT
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, path string) {
+	bucket := strings.TrimSuffix(path, "/o")
+	query := r.URL.Query()
+	name := query.Get("name")
+	if bucket == path || name == "" || query.Get("uploadType") != "media" {
+		http.Error(w, "unsupported upload", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := bucket + "/" + name
+	if match := query.Get("ifGenerationMatch"); match != "" {
+		expected, err := strconv.ParseInt(match, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid ifGenerationMatch", http.StatusBadRequest)
+			return
+		}
+		if expected != s.generations[key] {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+	}
+	generation := s.put(key, data)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket":     bucket,
+		"name":       name,
+		"generation": strconv.FormatInt(generation, 10),
+	})
+}
@@ -2,6 +2,8 @@ package cloud
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	cloudkms "cloud.google.com/go/kms/apiv1"
 	"github.com/vapor-ware/sctl/credentials"
@@ -12,9 +14,30 @@ import (
 // KMS is a contract interface that must be implemented for sctl to talk to the backing KMS service's
 // two methods of Encrypt and Decrypt, that return byte slices of plaintext/cyphertext respectively and
 // any unwrapped errors that surface from the operation.
+// Implementations may hold on to connections between calls, which are released by Close. Close must
+// be safe to call more than once.
+// The context bounds each call, including any retries of transient failures.
 type KMS interface {
-	Encrypt([]byte) ([]byte, error)
-	Decrypt([]byte) ([]byte, error)
+	Encrypt(context.Context, []byte) ([]byte, error)
+	Decrypt(context.Context, []byte) ([]byte, error)
+	Close() error
+}
+
+// KeyVersioner is implemented by KMS clients whose keys have versions, such as Cloud KMS, where
+// rotating a key creates a new primary version and leaves existing ciphertext on older ones.
+type KeyVersioner interface {
+	// EncryptVersion is Encrypt, also returning the name of the key version that was used.
+	EncryptVersion(context.Context, []byte) ([]byte, string, error)
+	// PrimaryVersion returns the name of the key version new ciphertext is encrypted with.
+	PrimaryVersion(context.Context) (string, error)
+}
+
+// PublicKeyEncrypter is implemented by KMS clients that encrypt with the public half of a key
+// pair, such as GCP asymmetric keys and recovery keys. Anyone able to see the public key can
+// encrypt with it, without any permission on the KMS.
+type PublicKeyEncrypter interface {
+	// EncryptsWithPublicKey reports whether Encrypt only needs the public key.
+	EncryptsWithPublicKey() bool
 }
 
 // GCPKMS is a Google Cloud Platform KMS client
@@ -25,46 +48,112 @@ type GCPKMS struct {
 	// eg: projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev
 
 	keyname string
+
+	// opts, when set, replace the endpoint and credentials the client is dialed with
+	opts []option.ClientOption
+
+	// the client is dialed on first use, and shared by every subsequent call until Close
+	mu        sync.Mutex
+	kmsClient *cloudkms.KeyManagementClient
 }
 
-// Construct and return a GoogleClient from JSON
+// Construct and return a GoogleClient from JSON. The client is created once and cached for
+// the lifetime of the GCPKMS, so bulk operations share a single connection.
 func (gkms *GCPKMS) client(ctx context.Context) (*cloudkms.KeyManagementClient, error) {
-	var cred credentials.GoogleCredential
+	gkms.mu.Lock()
+	defer gkms.mu.Unlock()
+	if gkms.kmsClient != nil {
+		return gkms.kmsClient, nil
+	}
 
-	// This does an abstract load of the credential. If os.env.GoogleApplicationCredential exists, it
-	// overloads any client logic and uses that. Otherwise it attempts to load the default credential
-	credentialJSON, err := cred.JSON()
+	opts := gkms.opts
+	if len(opts) == 0 {
+		var cred credentials.GoogleCredential
+
+		// This does an abstract load of the credential. If os.env.GoogleApplicationCredential exists, it
+		// overloads any client logic and uses that. Otherwise it attempts to load the default credential
+		credentialJSON, err := cred.JSON()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentialsJSON(credentialJSON))
+	}
+
+	client, err := cloudkms.NewKeyManagementClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
+	gkms.kmsClient = client
+	return client, nil
+}
 
-	return cloudkms.NewKeyManagementClient(ctx, option.WithCredentialsJSON(credentialJSON))
+// Close releases the cached KeyManagementClient connection, if one was dialed.
+func (gkms *GCPKMS) Close() error {
+	gkms.mu.Lock()
+	defer gkms.mu.Unlock()
+	if gkms.kmsClient == nil {
+		return nil
+	}
+	err := gkms.kmsClient.Close()
+	gkms.kmsClient = nil
+	return err
 }
 
 // Encrypt invokes GCP KMS to encrypt the data. Returns a bytestream of binary data.
-func (gkms *GCPKMS) Encrypt(plaintext []byte) ([]byte, error) {
-	ctx := context.Background()
+func (gkms *GCPKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	ciphertext, _, err := gkms.EncryptVersion(ctx, plaintext)
+	return ciphertext, err
+}
 
+// EncryptVersion invokes GCP KMS to encrypt the data, returning the ciphertext and the name of
+// the key version KMS encrypted it with.
+func (gkms *GCPKMS) EncryptVersion(ctx context.Context, plaintext []byte) ([]byte, string, error) {
 	client, err := gkms.client(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	// Build the request.
 	req := &kmspb.EncryptRequest{
 		Name:      gkms.keyname,
 		Plaintext: plaintext,
 	}
-	// Call the API.
-	resp, err := client.Encrypt(ctx, req)
+	// Call the API, retrying transient failures.
+	var resp *kmspb.EncryptResponse
+	err = withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		resp, err = client.Encrypt(ctx, req)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", fmt.Errorf("failed to encrypt with key %s: %w", gkms.keyname, err)
+	}
+	return resp.Ciphertext, resp.Name, nil
+}
+
+// PrimaryVersion looks up the name of the key's primary version.
+func (gkms *GCPKMS) PrimaryVersion(ctx context.Context) (string, error) {
+	client, err := gkms.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	req := &kmspb.GetCryptoKeyRequest{
+		Name: gkms.keyname,
+	}
+	var resp *kmspb.CryptoKey
+	err = withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		resp, err = client.GetCryptoKey(ctx, req)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up key %s: %w", gkms.keyname, err)
+	}
+	if resp.Primary == nil {
+		return "", fmt.Errorf("key %s has no primary version", gkms.keyname)
 	}
-	return resp.Ciphertext, nil
+	return resp.Primary.Name, nil
 }
 
 // Decrypt invokes the GCP KMS API to decrypt ciphertext.
-func (gkms *GCPKMS) Decrypt(ciphertext []byte) ([]byte, error) {
-	ctx := context.Background()
+func (gkms *GCPKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
 	client, err := gkms.client(ctx)
 	if err != nil {
 		return nil, err
@@ -75,20 +164,26 @@ func (gkms *GCPKMS) Decrypt(ciphertext []byte) ([]byte, error) {
 		Name:       gkms.keyname,
 		Ciphertext: ciphertext,
 	}
-	// Call the API.
-	resp, err := client.Decrypt(ctx, req)
+	// Call the API, retrying transient failures.
+	var resp *kmspb.DecryptResponse
+	err = withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		resp, err = client.Decrypt(ctx, req)
+		return err
+	})
 	if err != nil {
 		// if this fails, it's likely network or permissions related
-		return nil, err
+		return nil, fmt.Errorf("failed to decrypt with key %s: %w", gkms.keyname, err)
 	}
 
 	// return the decrypted data, and the error object
 	return resp.Plaintext, nil
 }
 
-// NewGCPKMS creates a new KMS client for Google Cloud Platform.
-func NewGCPKMS(keyname string) KMS {
+// NewGCPKMS creates a new KMS client for Google Cloud Platform. It is dialed with sctl's
+// Google credential, unless opts replace it, eg: to reach a stand-in such as cloud/kmstest.
+func NewGCPKMS(keyname string, opts ...option.ClientOption) KMS {
 	return &GCPKMS{
 		keyname: keyname,
+		opts:    opts,
 	}
 }
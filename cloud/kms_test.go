@@ -3,6 +3,7 @@
 package cloud
 
 import (
+	"context"
 	"os"
 	"reflect"
 	"testing"
@@ -34,10 +35,17 @@ func TestGCPKMSEncryptDecryptIntegration(t *testing.T) {
 		client = NewGCPKMS(key)
 	}
 
-	cypher, err := client.Encrypt([]byte("hello"))
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
 	assert.NoError(t, err)
 
-	decrypted, err := client.Decrypt(cypher)
+	decrypted, err := client.Decrypt(context.Background(), cypher)
 	assert.NoError(t, err)
 	assert.True(t, reflect.DeepEqual(decrypted, []byte("hello")))
 }
+
+// Closing a client that was never dialed, or closing it twice, must be harmless.
+func TestGCPKMSCloseUndialed(t *testing.T) {
+	client := NewGCPKMS(defaultTestKey)
+	assert.NoError(t, client.Close())
+	assert.NoError(t, client.Close())
+}
@@ -0,0 +1,138 @@
+// Package kmstest provides KMS implementations for use in tests, so code built on sctl can
+// be exercised without cloud credentials: Fake, an in-memory cloud.KMS, and Server, a
+// local stand-in for the Cloud KMS gRPC API.
+package kmstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/vapor-ware/sctl/cloud"
+)
+
+// Scheme is the key URI scheme under which Register makes fakes available, eg: fake://test-key
+const Scheme = "fake"
+
+// Fake is a deterministic, in-memory cloud.KMS. Encrypting the same plaintext with the same
+// key name always produces the same ciphertext, and ciphertext is bound to the key name, so
+// decrypting with another key fails as it would with a real KMS. It offers no security.
+type Fake struct {
+	KeyName string
+
+	// Err, when set, is returned by every Encrypt and Decrypt call
+	Err error
+
+	mu       sync.Mutex
+	encrypts int
+	decrypts int
+	closed   bool
+}
+
+var _ cloud.KMS = (*Fake)(nil)
+
+// NewFake creates a Fake for the named key.
+func NewFake(keyName string) *Fake {
+	return &Fake{KeyName: keyName}
+}
+
+// Register makes fakes available to cloud.NewKMS for key URIs using Scheme. Every call to
+// cloud.NewKMS creates a new Fake, which can decrypt anything encrypted by a Fake of the
+// same key name.
+func Register() {
+	cloud.Register(Scheme, func(key string) (cloud.KMS, error) {
+		return NewFake(key), nil
+	})
+}
+
+// Encrypt returns plaintext scrambled with a keystream derived from the key name.
+func (f *Fake) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if err := f.call(ctx, &f.encrypts); err != nil {
+		return nil, err
+	}
+	return append(f.header(), f.scramble(plaintext)...), nil
+}
+
+// Decrypt reverses Encrypt, failing if the ciphertext was encrypted with another key.
+func (f *Fake) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if err := f.call(ctx, &f.decrypts); err != nil {
+		return nil, err
+	}
+	header := f.header()
+	if !bytes.HasPrefix(ciphertext, header) {
+		return nil, fmt.Errorf("ciphertext was not encrypted with key %s", f.KeyName)
+	}
+	return f.scramble(ciphertext[len(header):]), nil
+}
+
+// Close marks the Fake as closed. It may be called more than once.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Calls returns the number of Encrypt and Decrypt calls made.
+func (f *Fake) Calls() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encrypts, f.decrypts
+}
+
+// Closed reports whether Close has been called.
+func (f *Fake) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// call records a call, and returns any error the call should fail with.
+func (f *Fake) call(ctx context.Context, counter *int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*counter++
+	if f.Err != nil {
+		return f.Err
+	}
+	return ctx.Err()
+}
+
+// fakeHeader starts the header of every ciphertext.
+const fakeHeader = "fakekms:"
+
+// header prefixes every ciphertext, identifying the key that produced it.
+func (f *Fake) header() []byte {
+	return []byte(fakeHeader + f.KeyName + ":")
+}
+
+// fakeKeyName returns the name of the key that produced a Fake's ciphertext.
+func fakeKeyName(ciphertext []byte) (string, bool) {
+	rest := bytes.TrimPrefix(ciphertext, []byte(fakeHeader))
+	if len(rest) == len(ciphertext) {
+		return "", false
+	}
+	end := bytes.IndexByte(rest, ':')
+	if end < 0 {
+		return "", false
+	}
+	return string(rest[:end]), true
+}
+
+// scramble xors data with a keystream of SHA-256 blocks over the key name and a counter.
+func (f *Fake) scramble(data []byte) []byte {
+	out := make([]byte, len(data))
+	var block [sha256.Size]byte
+	counter := make([]byte, 8)
+	for i := range data {
+		if i%sha256.Size == 0 {
+			binary.BigEndian.PutUint64(counter, uint64(i/sha256.Size))
+			block = sha256.Sum256(append([]byte(f.KeyName), counter...))
+		}
+		out[i] = data[i] ^ block[i%sha256.Size]
+	}
+	return out
+}
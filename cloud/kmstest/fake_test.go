@@ -0,0 +1,66 @@
+package kmstest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/cloud"
+)
+
+func TestFakeEncryptDecrypt(t *testing.T) {
+	fake := NewFake("test-key")
+
+	cypher, err := fake.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(cypher), "hello")
+
+	// Deterministic
+	again, err := fake.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, cypher, again)
+
+	decrypted, err := fake.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	// Bound to the key name
+	_, err = NewFake("other-key").Decrypt(context.Background(), cypher)
+	assert.Error(t, err)
+
+	encrypts, decrypts := fake.Calls()
+	assert.Equal(t, 2, encrypts)
+	assert.Equal(t, 1, decrypts)
+}
+
+func TestFakeErrors(t *testing.T) {
+	fake := NewFake("test-key")
+	fake.Err = errors.New("boom")
+	_, err := fake.Encrypt(context.Background(), []byte("hello"))
+	assert.EqualError(t, err, "boom")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewFake("test-key").Decrypt(ctx, []byte("fakekms:test-key:"))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRegister(t *testing.T) {
+	Register()
+
+	client, err := cloud.NewKMS("fake://test-key")
+	assert.NoError(t, err)
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	// A separately constructed client of the same key can decrypt
+	other, err := cloud.NewKMS("fake://test-key")
+	assert.NoError(t, err)
+	decrypted, err := other.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	assert.NoError(t, client.Close())
+	assert.True(t, client.(*Fake).Closed())
+}
@@ -0,0 +1,256 @@
+package kmstest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vapor-ware/sctl/cloud"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// keyVersionSegment separates a crypto key from one of its versions in a resource name.
+const keyVersionSegment = "/cryptoKeyVersions/"
+
+// Server is a local stand-in for the Cloud KMS gRPC API. Symmetric keys encrypt with a
+// Fake named after their primary key version, which starts at 1 and is advanced by
+// RotateKey, and asymmetric decryption keys (any resource name addressing a key version)
+// are backed by an RSA key generated on first use. Every key exists without having to be
+// created first.
+type Server struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+
+	// Addr is the host:port the server is listening on
+	Addr string
+
+	grpcServer *grpc.Server
+
+	mu         sync.Mutex
+	asymmetric map[string]*rsa.PrivateKey
+	primary    map[string]int
+	failures   []codes.Code
+}
+
+// NewServer starts a Server listening on a random local port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:       listener.Addr().String(),
+		grpcServer: grpc.NewServer(),
+		asymmetric: map[string]*rsa.PrivateKey{},
+		primary:    map[string]int{},
+	}
+	kmspb.RegisterKeyManagementServiceServer(s.grpcServer, s)
+	go s.grpcServer.Serve(listener)
+	return s, nil
+}
+
+// Start starts a Server for the duration of a test, and points the gcpkms:// and
+// gcpkms-rsa:// key URIs at it with cloud.RegisterGCP.
+func Start(t testing.TB) *Server {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("failed to start KMS stand-in: %v", err)
+	}
+	cloud.RegisterGCP(s.ClientOptions()...)
+	t.Cleanup(func() {
+		cloud.RegisterGCP()
+		s.Close()
+	})
+	return s
+}
+
+// ClientOptions dial the server without TLS or credentials, eg: for cloud.NewGCPKMS.
+func (s *Server) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(s.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpcServer.Stop()
+}
+
+// FailNext makes the next count calls to the server fail with the given code, eg:
+// codes.Unavailable to exercise retries.
+func (s *Server) FailNext(code codes.Code, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < count; i++ {
+		s.failures = append(s.failures, code)
+	}
+}
+
+// injectedFailure returns the next failure queued by FailNext, if any.
+func (s *Server) injectedFailure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures) == 0 {
+		return nil
+	}
+	code := s.failures[0]
+	s.failures = s.failures[1:]
+	return status.Error(code, "failure injected by kmstest")
+}
+
+// RotateKey creates a new primary version of the named crypto key, returning its name.
+// Ciphertext encrypted with earlier versions can still be decrypted.
+func (s *Server) RotateKey(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = cryptoKeyName(name)
+	s.primary[name] = s.primaryVersion(name) + 1
+	return fmt.Sprintf("%s%s%d", name, keyVersionSegment, s.primary[name])
+}
+
+// primaryVersion returns the primary version number of a crypto key. s.mu must be held.
+func (s *Server) primaryVersion(name string) int {
+	if version, found := s.primary[name]; found {
+		return version
+	}
+	return 1
+}
+
+// primaryVersionName returns the resource name of a crypto key's primary version.
+func (s *Server) primaryVersionName(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%s%s%d", name, keyVersionSegment, s.primaryVersion(name))
+}
+
+// Encrypt encrypts with the Fake for the named key version, or the primary version of the
+// named crypto key.
+func (s *Server) Encrypt(ctx context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	if err := s.injectedFailure(); err != nil {
+		return nil, err
+	}
+	name := req.Name
+	if !strings.Contains(name, keyVersionSegment) {
+		name = s.primaryVersionName(name)
+	}
+	ciphertext, err := NewFake(name).Encrypt(ctx, req.Plaintext)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &kmspb.EncryptResponse{
+		Name:       name,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Decrypt decrypts with the Fake for the key version named in the ciphertext, provided it
+// is a version of the named crypto key.
+func (s *Server) Decrypt(ctx context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	if err := s.injectedFailure(); err != nil {
+		return nil, err
+	}
+	version, ok := fakeKeyName(req.Ciphertext)
+	if !ok || cryptoKeyName(version) != cryptoKeyName(req.Name) {
+		return nil, status.Error(codes.InvalidArgument, "Decryption failed: the ciphertext is invalid.")
+	}
+	plaintext, err := NewFake(version).Decrypt(ctx, req.Ciphertext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Decryption failed: the ciphertext is invalid.")
+	}
+	return &kmspb.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// GetCryptoKey describes the named crypto key and its primary version.
+func (s *Server) GetCryptoKey(ctx context.Context, req *kmspb.GetCryptoKeyRequest) (*kmspb.CryptoKey, error) {
+	if err := s.injectedFailure(); err != nil {
+		return nil, err
+	}
+	return &kmspb.CryptoKey{
+		Name:    req.Name,
+		Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		Primary: &kmspb.CryptoKeyVersion{
+			Name:  s.primaryVersionName(req.Name),
+			State: kmspb.CryptoKeyVersion_ENABLED,
+		},
+	}, nil
+}
+
+// GetPublicKey returns the public half of the RSA key for the named key version.
+func (s *Server) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest) (*kmspb.PublicKey, error) {
+	if err := s.injectedFailure(); err != nil {
+		return nil, err
+	}
+	key, err := s.asymmetricKey(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	pemData := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return &kmspb.PublicKey{
+		Pem:       pemData,
+		PemCrc32C: wrapperspb.Int64(int64(crc32.Checksum([]byte(pemData), crc32.MakeTable(crc32.Castagnoli)))),
+		Algorithm: kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256,
+		Name:      req.Name,
+	}, nil
+}
+
+// AsymmetricDecrypt decrypts RSA-OAEP ciphertext with the RSA key for the named key version.
+func (s *Server) AsymmetricDecrypt(ctx context.Context, req *kmspb.AsymmetricDecryptRequest) (*kmspb.AsymmetricDecryptResponse, error) {
+	if err := s.injectedFailure(); err != nil {
+		return nil, err
+	}
+	key, err := s.asymmetricKey(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), nil, key, req.Ciphertext, nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Decryption failed: the ciphertext is invalid.")
+	}
+	return &kmspb.AsymmetricDecryptResponse{Plaintext: plaintext}, nil
+}
+
+// asymmetricKey returns the RSA key for a key version, generating it on first use.
+func (s *Server) asymmetricKey(name string) (*rsa.PrivateKey, error) {
+	if !strings.Contains(name, keyVersionSegment) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not a key version", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, found := s.asymmetric[name]; found {
+		return key, nil
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.asymmetric[name] = key
+	return key, nil
+}
+
+// cryptoKeyName strips any key version from a resource name.
+func cryptoKeyName(name string) string {
+	if idx := strings.Index(name, keyVersionSegment); idx >= 0 {
+		return name[:idx]
+	}
+	return name
+}
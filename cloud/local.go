@@ -0,0 +1,151 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// LocalScheme is the key URI prefix identifying a key file stored on local disk,
+// eg: local://path/to/keyfile
+const LocalScheme = "local://"
+
+// localKeySize is the size in bytes of a local AES-256 key.
+const localKeySize = 32
+
+// LocalKMS is an offline stand-in for a cloud KMS. It performs authenticated
+// symmetric encryption (AES-256-GCM) with a key read from a file on disk, so
+// envelopes can be sealed and opened without network access or cloud credentials.
+type LocalKMS struct {
+	// property keyfile - the path to the file holding the base64 encoded key
+	// eg: /home/user/.config/sctl/dev.key
+
+	keyfile string
+
+	// the key is read from disk on first use, and held in memory until Close
+	mu        sync.Mutex
+	cachedKey []byte
+}
+
+// key reads and decodes the AES key from the configured keyfile.
+func (lkms *LocalKMS) key() ([]byte, error) {
+	lkms.mu.Lock()
+	defer lkms.mu.Unlock()
+	if lkms.cachedKey != nil {
+		return lkms.cachedKey, nil
+	}
+
+	data, err := os.ReadFile(lkms.keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("local key %s is not base64 encoded: %w", lkms.keyfile, err)
+	}
+	if len(key) != localKeySize {
+		return nil, fmt.Errorf("local key %s must be %d bytes, found %d", lkms.keyfile, localKeySize, len(key))
+	}
+	lkms.cachedKey = key
+	return key, nil
+}
+
+// Encrypt seals the plaintext with the local key. The returned ciphertext is the random
+// nonce followed by the AES-GCM sealed data.
+func (lkms *LocalKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := lkms.key()
+	if err != nil {
+		return nil, err
+	}
+	return sealAESGCM(key, plaintext, nil)
+}
+
+// Decrypt opens ciphertext previously sealed with the local key.
+func (lkms *LocalKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	key, err := lkms.key()
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(key, ciphertext, nil)
+}
+
+// Close scrubs the cached key from memory.
+func (lkms *LocalKMS) Close() error {
+	lkms.mu.Lock()
+	defer lkms.mu.Unlock()
+	for i := range lkms.cachedKey {
+		lkms.cachedKey[i] = 0
+	}
+	lkms.cachedKey = nil
+	return nil
+}
+
+// NewLocalKMS creates a new KMS client backed by the key stored in keyfile.
+func NewLocalKMS(keyfile string) KMS {
+	return &LocalKMS{
+		keyfile: keyfile,
+	}
+}
+
+// GenerateLocalKey writes a new random key suitable for use with LocalKMS to path. It
+// refuses to overwrite an existing file, as doing so would orphan anything sealed with it.
+func GenerateLocalKey(path string) error {
+	key := make([]byte, localKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sealAESGCM encrypts plaintext with AES-GCM under key, prefixing the output with the nonce.
+// The additional data aad is authenticated but not encrypted, and may be nil.
+func sealAESGCM(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// openAESGCM reverses sealAESGCM, authenticating the ciphertext and aad before returning
+// plaintext.
+func openAESGCM(key []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, aad)
+}
@@ -0,0 +1,123 @@
+package cloud
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test Case Setup - generate a key in a temporary directory
+func testLocalKey(t *testing.T) (string, string) {
+	tempPath, err := os.MkdirTemp("", t.Name())
+	assert.NoError(t, err)
+
+	keyfile := filepath.Join(tempPath, "test.key")
+	err = GenerateLocalKey(keyfile)
+	assert.NoError(t, err)
+	return tempPath, keyfile
+}
+
+func TestLocalKMSEncryptDecrypt(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+
+	client := NewLocalKMS(keyfile)
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, []byte("hello"), cypher)
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
+
+func TestLocalKMSTamperedCiphertext(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+
+	client := NewLocalKMS(keyfile)
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	cypher[len(cypher)-1] ^= 0xff
+	_, err = client.Decrypt(context.Background(), cypher)
+	assert.Error(t, err)
+
+	_, err = client.Decrypt(context.Background(), []byte("short"))
+	assert.Error(t, err)
+}
+
+func TestLocalKMSWrongKey(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+
+	otherKey := filepath.Join(tempPath, "other.key")
+	err := GenerateLocalKey(otherKey)
+	assert.NoError(t, err)
+
+	cypher, err := NewLocalKMS(keyfile).Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	_, err = NewLocalKMS(otherKey).Decrypt(context.Background(), cypher)
+	assert.Error(t, err)
+}
+
+func TestLocalKMSBadKeyfile(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var testTable = []struct {
+		name     string
+		contents string
+	}{
+		{"Not Base64", "not a key!"},
+		{"Wrong Length", "c2hvcnQ="},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			keyfile := filepath.Join(tempPath, "bad.key")
+			err := os.WriteFile(keyfile, []byte(tt.contents), 0600)
+			assert.NoError(t, err)
+
+			_, err = NewLocalKMS(keyfile).Encrypt(context.Background(), []byte("hello"))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = NewLocalKMS(filepath.Join(tempPath, "missing.key")).Encrypt(context.Background(), []byte("hello"))
+	assert.Error(t, err)
+}
+
+// Generating a key must never clobber an existing key file.
+func TestGenerateLocalKeyNoOverwrite(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+
+	err := GenerateLocalKey(keyfile)
+	assert.Error(t, err)
+}
+
+// The key is cached after first use and scrubbed on Close, after which the client
+// transparently re-reads it from disk.
+func TestLocalKMSClose(t *testing.T) {
+	tempPath, keyfile := testLocalKey(t)
+	defer os.RemoveAll(tempPath)
+
+	client := NewLocalKMS(keyfile).(*LocalKMS)
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.Len(t, client.cachedKey, localKeySize)
+
+	assert.NoError(t, client.Close())
+	assert.Nil(t, client.cachedKey)
+	assert.NoError(t, client.Close())
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
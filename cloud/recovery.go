@@ -0,0 +1,121 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// RecoveryScheme is the key URI scheme of break-glass recovery keys. The key name is the
+// public half of the recovery key, eg: recovery://BASE64URL
+const RecoveryScheme = "recovery://"
+
+// recoveryKeySize is the size in bytes of a recovery key (an X25519 private key).
+const recoveryKeySize = 32
+
+// ErrRecoveryKeySealed is returned when decrypting with a recovery key that has only its
+// public half, as is the case for every use of a recovery key outside of unsealing.
+var ErrRecoveryKeySealed = errors.New("the recovery key is sealed - use sctl recovery unseal")
+
+// RecoveryKMS is a break-glass recipient backed by an X25519 key pair. Only the public key
+// is known day to day, which is enough to wrap data keys. The private key is kept offline,
+// split amongst custodians, and is only reassembled to decrypt in an emergency.
+type RecoveryKMS struct {
+	publicKey  [recoveryKeySize]byte
+	privateKey *[recoveryKeySize]byte
+}
+
+// Encrypt seals plaintext to the recovery public key with an anonymous NaCl box.
+func (rkms *RecoveryKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return box.SealAnonymous(nil, plaintext, &rkms.publicKey, rand.Reader)
+}
+
+// Decrypt opens ciphertext sealed to the recovery key. It fails with ErrRecoveryKeySealed
+// unless the key was reassembled by UnsealRecoveryKey.
+func (rkms *RecoveryKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if rkms.privateKey == nil {
+		return nil, ErrRecoveryKeySealed
+	}
+	plaintext, ok := box.OpenAnonymous(nil, ciphertext, &rkms.publicKey, rkms.privateKey)
+	if !ok {
+		return nil, errors.New("failed to decrypt with the recovery key")
+	}
+	return plaintext, nil
+}
+
+// EncryptsWithPublicKey is always true, as the public key is all that is needed to encrypt.
+func (rkms *RecoveryKMS) EncryptsWithPublicKey() bool {
+	return true
+}
+
+// Close scrubs the private key from memory, if it was unsealed.
+func (rkms *RecoveryKMS) Close() error {
+	if rkms.privateKey != nil {
+		for i := range rkms.privateKey {
+			rkms.privateKey[i] = 0
+		}
+		rkms.privateKey = nil
+	}
+	return nil
+}
+
+// NewRecoveryKMS creates a KMS client for the recovery public key named by key, which can
+// wrap data keys but not unwrap them.
+func NewRecoveryKMS(key string) (KMS, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(decoded) != recoveryKeySize {
+		return nil, fmt.Errorf("invalid recovery key %q", key)
+	}
+	rkms := &RecoveryKMS{}
+	copy(rkms.publicKey[:], decoded)
+	return rkms, nil
+}
+
+// GenerateRecoveryKey creates a new random recovery key, returning the private key to be
+// split amongst custodians, and the key URI of its public half.
+func GenerateRecoveryKey() ([]byte, string, error) {
+	privateKey := make([]byte, recoveryKeySize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, "", err
+	}
+	keyURI, err := recoveryKeyURI(privateKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return privateKey, keyURI, nil
+}
+
+// UnsealRecoveryKey returns a KMS client able to decrypt with the recovery private key,
+// along with the key URI of its public half.
+func UnsealRecoveryKey(privateKey []byte) (KMS, string, error) {
+	if len(privateKey) != recoveryKeySize {
+		return nil, "", errors.New("invalid recovery key")
+	}
+	keyURI, err := recoveryKeyURI(privateKey)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := NewRecoveryKMS(keyURI[len(RecoveryScheme):])
+	if err != nil {
+		return nil, "", err
+	}
+	rkms := client.(*RecoveryKMS)
+	rkms.privateKey = new([recoveryKeySize]byte)
+	copy(rkms.privateKey[:], privateKey)
+	return rkms, keyURI, nil
+}
+
+// recoveryKeyURI derives the key URI naming the public half of a recovery private key.
+func recoveryKeyURI(privateKey []byte) (string, error) {
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return RecoveryScheme + base64.RawURLEncoding.EncodeToString(publicKey), nil
+}
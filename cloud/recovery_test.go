@@ -0,0 +1,56 @@
+package cloud
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryKMS(t *testing.T) {
+	privateKey, keyURI, err := GenerateRecoveryKey()
+	assert.NoError(t, err)
+	assert.Len(t, privateKey, recoveryKeySize)
+	assert.True(t, strings.HasPrefix(keyURI, RecoveryScheme))
+
+	// The public half can only wrap
+	client, err := NewKMS(keyURI)
+	assert.NoError(t, err)
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	_, err = client.Decrypt(context.Background(), cypher)
+	assert.Equal(t, ErrRecoveryKeySealed, err)
+
+	// The unsealed key can unwrap
+	unsealed, unsealedURI, err := UnsealRecoveryKey(privateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, keyURI, unsealedURI)
+	decrypted, err := unsealed.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+
+	// Another recovery key can not
+	otherKey, _, err := GenerateRecoveryKey()
+	assert.NoError(t, err)
+	other, _, err := UnsealRecoveryKey(otherKey)
+	assert.NoError(t, err)
+	_, err = other.Decrypt(context.Background(), cypher)
+	assert.Error(t, err)
+
+	// Closing scrubs the private key
+	assert.NoError(t, unsealed.Close())
+	_, err = unsealed.Decrypt(context.Background(), cypher)
+	assert.Equal(t, ErrRecoveryKeySealed, err)
+}
+
+func TestNewRecoveryKMSErrors(t *testing.T) {
+	_, err := NewKMS("recovery://not-a-key")
+	assert.Error(t, err)
+
+	_, err = NewKMS("recovery://")
+	assert.Error(t, err)
+
+	_, _, err = UnsealRecoveryKey([]byte("short"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package cloud
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/option"
+)
+
+// schemeSeparator splits a key URI into its provider scheme and provider specific key name.
+const schemeSeparator = "://"
+
+// defaultScheme is presumed for key URIs that do not declare a scheme. Envelopes written
+// before providers were introduced store bare GCP resource names, eg: projects/sctl/...
+const defaultScheme = "gcpkms"
+
+// Provider constructs a KMS client for a provider specific key name, which is the portion
+// of the key URI following the scheme. eg: for gcpkms://projects/sctl/... the key name is
+// projects/sctl/...
+type Provider func(key string) (KMS, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{
+		"awskms": func(key string) (KMS, error) {
+			return NewAWSKMS(key), nil
+		},
+		defaultScheme:       gcpProvider(nil),
+		gcpAsymmetricScheme: gcpAsymmetricProvider(nil),
+		"local": func(key string) (KMS, error) {
+			return NewLocalKMS(key), nil
+		},
+		"recovery": NewRecoveryKMS,
+		"vault": func(key string) (KMS, error) {
+			return NewVaultKMS(key), nil
+		},
+	}
+)
+
+// Register makes a KMS provider available for key URIs using the given scheme. Registering
+// a scheme that already exists replaces the previous provider.
+func Register(scheme string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[scheme] = provider
+}
+
+// RegisterGCP makes Cloud KMS keys available for key URIs using the gcpkms and gcpkms-rsa
+// schemes, with clients dialed with opts, eg: to reach a stand-in such as cloud/kmstest.
+// Without opts, clients are dialed with sctl's Google credential, as they are by default.
+func RegisterGCP(opts ...option.ClientOption) {
+	Register(defaultScheme, gcpProvider(opts))
+	Register(gcpAsymmetricScheme, gcpAsymmetricProvider(opts))
+}
+
+// gcpProvider creates Cloud KMS clients dialed with opts, see NewGCPKMS.
+func gcpProvider(opts []option.ClientOption) Provider {
+	return func(key string) (KMS, error) {
+		return NewGCPKMS(key, opts...), nil
+	}
+}
+
+// gcpAsymmetricProvider creates Cloud KMS clients for asymmetric key versions dialed with
+// opts, see NewGCPAsymmetricKMS.
+func gcpAsymmetricProvider(opts []option.ClientOption) Provider {
+	return func(key string) (KMS, error) {
+		if !strings.Contains(key, gcpKeyVersionSegment) {
+			return nil, fmt.Errorf("asymmetric key %q must name a key version, eg: .../cryptoKeys/KEY/cryptoKeyVersions/1", key)
+		}
+		return NewGCPAsymmetricKMS(key, opts...), nil
+	}
+}
+
+// ParseKeyURI splits a key URI into its scheme and provider specific key name. Key URIs
+// without a scheme are presumed to be GCP KMS resource names for backwards compatibility.
+func ParseKeyURI(keyURI string) (string, string) {
+	idx := strings.Index(keyURI, schemeSeparator)
+	if idx < 0 {
+		return defaultScheme, keyURI
+	}
+	return keyURI[:idx], keyURI[idx+len(schemeSeparator):]
+}
+
+// NewKMS returns a KMS client for the provider named by the scheme of the key URI,
+// eg: gcpkms://, gcpkms-rsa://, awskms://, vault://, local://
+func NewKMS(keyURI string) (KMS, error) {
+	scheme, key := ParseKeyURI(keyURI)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("missing key name in key URI %q", keyURI)
+	}
+
+	providersMu.RLock()
+	provider, found := providers[scheme]
+	providersMu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unsupported KMS provider %q in key URI %q", scheme, keyURI)
+	}
+	return provider(key)
+}
@@ -0,0 +1,66 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyURI(t *testing.T) {
+	var testTable = []struct {
+		name   string
+		keyURI string
+		scheme string
+		key    string
+	}{
+		{"Bare GCP", "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev", "gcpkms", "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"},
+		{"Bare GCP Leading Slash", "/projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev", "gcpkms", "/projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"},
+		{"GCP Scheme", "gcpkms://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev", "gcpkms", "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"},
+		{"Local Relative", "local://keys/dev.key", "local", "keys/dev.key"},
+		{"Local Absolute", "local:///etc/sctl/dev.key", "local", "/etc/sctl/dev.key"},
+		{"Vault", "vault://transit/sctl", "vault", "transit/sctl"},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, key := ParseKeyURI(tt.keyURI)
+			assert.Equal(t, tt.scheme, scheme)
+			assert.Equal(t, tt.key, key)
+		})
+	}
+}
+
+func TestNewKMS(t *testing.T) {
+	client, err := NewKMS("projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev")
+	assert.NoError(t, err)
+	assert.IsType(t, &GCPKMS{}, client)
+
+	client, err = NewKMS("gcpkms://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev", client.(*GCPKMS).keyname)
+
+	client, err = NewKMS("local://keys/dev.key")
+	assert.NoError(t, err)
+	assert.Equal(t, "keys/dev.key", client.(*LocalKMS).keyfile)
+}
+
+func TestNewKMSErrors(t *testing.T) {
+	_, err := NewKMS("unknown://some/key")
+	assert.Error(t, err)
+
+	_, err = NewKMS("local://")
+	assert.Error(t, err)
+
+	_, err = NewKMS("")
+	assert.Error(t, err)
+}
+
+func TestRegister(t *testing.T) {
+	Register("test", func(key string) (KMS, error) {
+		return NewLocalKMS(key), nil
+	})
+
+	client, err := NewKMS("test://some.key")
+	assert.NoError(t, err)
+	assert.Equal(t, "some.key", client.(*LocalKMS).keyfile)
+}
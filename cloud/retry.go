@@ -0,0 +1,70 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Retry tuning for transient KMS failures. These are variables so tests can shorten the delays.
+var (
+	// retryAttempts is the maximum number of times a KMS call is attempted
+	retryAttempts = 5
+	// retryBaseDelay is the delay ceiling before the first retry, doubling on each attempt
+	retryBaseDelay = 200 * time.Millisecond
+	// retryMaxDelay caps the delay ceiling between any two attempts
+	retryMaxDelay = 5 * time.Second
+)
+
+// withRetry calls fn until it succeeds, returns an error that is not retryable, the attempts
+// are exhausted, or ctx is done. Delays between attempts grow exponentially and are fully
+// jittered, so parallel callers do not retry in lockstep.
+func withRetry(ctx context.Context, retryable func(error) bool, fn func(context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= retryAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if attempt == retryAttempts {
+			break
+		}
+
+		delay := backoff(attempt)
+		log.Debugf("transient KMS error on attempt %d, retrying in %s: %v", attempt, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", retryAttempts, err)
+}
+
+// backoff returns a random delay between zero and the exponential ceiling for the attempt.
+func backoff(attempt int) time.Duration {
+	ceiling := retryBaseDelay << uint(attempt-1)
+	if ceiling <= 0 || ceiling > retryMaxDelay {
+		ceiling = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isTransientGRPC reports whether a gRPC error is worth retrying.
+func isTransientGRPC(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Shrink the retry delays so the tests do not spend their time sleeping.
+func testFastRetry(t *testing.T) {
+	base, max := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 2*time.Millisecond
+	t.Cleanup(func() {
+		retryBaseDelay, retryMaxDelay = base, max
+	})
+}
+
+func TestWithRetryEventuallySucceeds(t *testing.T) {
+	testFastRetry(t)
+
+	calls := 0
+	err := withRetry(context.Background(), isTransientGRPC, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return status.Error(codes.Unavailable, "connection reset")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestWithRetryExhausted(t *testing.T) {
+	testFastRetry(t)
+
+	calls := 0
+	err := withRetry(context.Background(), isTransientGRPC, func(ctx context.Context) error {
+		calls++
+		return status.Error(codes.DeadlineExceeded, "slow")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, retryAttempts, calls)
+	assert.Contains(t, err.Error(), "giving up after 5 attempts")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(errors.Unwrap(err)))
+}
+
+func TestWithRetryPermanentError(t *testing.T) {
+	testFastRetry(t)
+
+	calls := 0
+	err := withRetry(context.Background(), isTransientGRPC, func(ctx context.Context) error {
+		calls++
+		return status.Error(codes.PermissionDenied, "denied")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestWithRetryContextDone(t *testing.T) {
+	testFastRetry(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	err := withRetry(ctx, isTransientGRPC, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return status.Error(codes.Unavailable, "connection reset")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBackoffBounds(t *testing.T) {
+	for attempt := 1; attempt < 64; attempt++ {
+		delay := backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, retryMaxDelay)
+	}
+}
+
+func TestIsTransientGRPC(t *testing.T) {
+	assert.True(t, isTransientGRPC(status.Error(codes.Unavailable, "")))
+	assert.True(t, isTransientGRPC(status.Error(codes.DeadlineExceeded, "")))
+	assert.False(t, isTransientGRPC(status.Error(codes.InvalidArgument, "")))
+	assert.False(t, isTransientGRPC(errors.New("not grpc")))
+}
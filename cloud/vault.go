@@ -0,0 +1,199 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables consulted when configuring the Vault client. These mirror the
+// variables used by the vault CLI so existing operator configuration is honoured.
+const (
+	VaultAddrVar         = "VAULT_ADDR"
+	VaultTokenVar        = "VAULT_TOKEN"
+	VaultNamespaceVar    = "VAULT_NAMESPACE"
+	VaultRoleIDVar       = "VAULT_ROLE_ID"
+	VaultSecretIDVar     = "VAULT_SECRET_ID"
+	VaultAppRoleMountVar = "VAULT_APPROLE_MOUNT"
+)
+
+const (
+	defaultVaultAddr         = "https://127.0.0.1:8200"
+	defaultVaultTransitMount = "transit"
+	defaultVaultAppRoleMount = "approle"
+)
+
+// VaultKMS is a HashiCorp Vault Transit secrets engine client.
+// Encryption and decryption are delegated to the Transit encrypt/decrypt endpoints, so
+// key material never leaves Vault.
+type VaultKMS struct {
+	// property address - the URL of the vault server, eg: https://vault.example.com:8200
+	// property mount - the path the transit engine is mounted at, eg: transit
+	// property keyname - the name of the transit key, eg: sctl-dev
+
+	address   string
+	mount     string
+	keyname   string
+	token     string
+	namespace string
+
+	// AppRole credentials, used to log in when no token is provided. The login is
+	// serialized so concurrent callers share a single token.
+	loginMu      sync.Mutex
+	roleID       string
+	secretID     string
+	appRoleMount string
+
+	httpClient *http.Client
+}
+
+// vaultResponse is the subset of the vault API response envelope consumed by sctl.
+type vaultResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// login resolves the token used to authenticate with vault, performing an AppRole login
+// if no token has been configured.
+func (vkms *VaultKMS) login(ctx context.Context) (string, error) {
+	vkms.loginMu.Lock()
+	defer vkms.loginMu.Unlock()
+	if vkms.token != "" {
+		return vkms.token, nil
+	}
+	if vkms.roleID == "" {
+		return "", fmt.Errorf("missing vault credentials - set %s, or %s and %s", VaultTokenVar, VaultRoleIDVar, VaultSecretIDVar)
+	}
+
+	resp, err := vkms.do(ctx, "", "auth/"+vkms.appRoleMount+"/login", map[string]string{
+		"role_id":   vkms.roleID,
+		"secret_id": vkms.secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vault approle login returned no client token")
+	}
+	vkms.token = resp.Auth.ClientToken
+	return vkms.token, nil
+}
+
+// do issues a POST against the vault API path with the JSON encoded body, and decodes
+// the response envelope.
+func (vkms *VaultKMS) do(ctx context.Context, token string, path string, body interface{}) (vaultResponse, error) {
+	var decoded vaultResponse
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return decoded, err
+	}
+	url := strings.TrimRight(vkms.address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return decoded, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if vkms.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vkms.namespace)
+	}
+
+	resp, err := vkms.httpClient.Do(req)
+	if err != nil {
+		return decoded, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil && resp.StatusCode < 300 {
+		return decoded, fmt.Errorf("unable to decode vault response from %s: %w", path, err)
+	}
+	if resp.StatusCode >= 300 {
+		if len(decoded.Errors) > 0 {
+			return decoded, fmt.Errorf("vault %s returned %d: %s", path, resp.StatusCode, strings.Join(decoded.Errors, "; "))
+		}
+		return decoded, fmt.Errorf("vault %s returned %d", path, resp.StatusCode)
+	}
+	return decoded, nil
+}
+
+// Encrypt invokes the Transit encrypt endpoint. Returns the vault ciphertext, eg: vault:v1:...
+func (vkms *VaultKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	token, err := vkms.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := vkms.do(ctx, token, vkms.mount+"/encrypt/"+vkms.keyname, map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with key %s/%s: %w", vkms.mount, vkms.keyname, err)
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// Decrypt invokes the Transit decrypt endpoint with ciphertext previously returned by Encrypt.
+func (vkms *VaultKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	token, err := vkms.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := vkms.do(ctx, token, vkms.mount+"/decrypt/"+vkms.keyname, map[string]string{
+		"ciphertext": string(ciphertext),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s/%s: %w", vkms.mount, vkms.keyname, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// Close releases any idle connections held open to the vault server.
+func (vkms *VaultKMS) Close() error {
+	vkms.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// NewVaultKMS creates a new KMS client for a Vault Transit key. The key is named as
+// MOUNT/KEY, eg: transit/sctl-dev. If no mount is given it defaults to "transit".
+// The vault address and credentials are read from the environment.
+func NewVaultKMS(key string) KMS {
+	mount, keyname := defaultVaultTransitMount, key
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		mount, keyname = key[:idx], key[idx+1:]
+	}
+
+	vkms := &VaultKMS{
+		address:      os.Getenv(VaultAddrVar),
+		mount:        strings.Trim(mount, "/"),
+		keyname:      keyname,
+		token:        os.Getenv(VaultTokenVar),
+		namespace:    os.Getenv(VaultNamespaceVar),
+		roleID:       os.Getenv(VaultRoleIDVar),
+		secretID:     os.Getenv(VaultSecretIDVar),
+		appRoleMount: os.Getenv(VaultAppRoleMountVar),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if vkms.address == "" {
+		vkms.address = defaultVaultAddr
+	}
+	if vkms.appRoleMount == "" {
+		vkms.appRoleMount = defaultVaultAppRoleMount
+	}
+	return vkms
+}
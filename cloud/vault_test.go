@@ -0,0 +1,154 @@
+package cloud
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVaultToken = "s.testtoken"
+
+// newTestTransit stands up a minimal imitation of the vault Transit API. The "ciphertext"
+// it issues is simply the base64 plaintext tagged with the key name, which is enough to
+// verify that sctl speaks the protocol correctly.
+func newTestTransit(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+
+		if r.URL.Path == "/v1/auth/approle/login" {
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"` + testVaultToken + `"}}`))
+			return
+		}
+
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/v1/transit/encrypt/sctl":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"ciphertext": "vault:v1:sctl:" + body["plaintext"]},
+			})
+		case r.URL.Path == "/v1/transit/decrypt/sctl":
+			if !strings.HasPrefix(body["ciphertext"], "vault:v1:sctl:") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid ciphertext"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"plaintext": strings.TrimPrefix(body["ciphertext"], "vault:v1:sctl:")},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestNewVaultKMS(t *testing.T) {
+	t.Setenv(VaultAddrVar, "http://vault.example.com:8200")
+	t.Setenv(VaultTokenVar, "token")
+
+	var testTable = []struct {
+		name    string
+		key     string
+		mount   string
+		keyname string
+	}{
+		{"Default Mount", "sctl-dev", "transit", "sctl-dev"},
+		{"Explicit Mount", "transit/sctl-dev", "transit", "sctl-dev"},
+		{"Nested Mount", "team/transit/sctl-dev", "team/transit", "sctl-dev"},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewVaultKMS(tt.key).(*VaultKMS)
+			assert.Equal(t, tt.mount, client.mount)
+			assert.Equal(t, tt.keyname, client.keyname)
+			assert.Equal(t, "http://vault.example.com:8200", client.address)
+			assert.Equal(t, "token", client.token)
+		})
+	}
+}
+
+func TestVaultKMSEncryptDecryptToken(t *testing.T) {
+	server := newTestTransit(t)
+	defer server.Close()
+	t.Setenv(VaultAddrVar, server.URL)
+	t.Setenv(VaultTokenVar, testVaultToken)
+
+	client, err := NewKMS("vault://transit/sctl")
+	assert.NoError(t, err)
+
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "vault:v1:sctl:"+base64.StdEncoding.EncodeToString([]byte("hello")), string(cypher))
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
+
+func TestVaultKMSEncryptDecryptAppRole(t *testing.T) {
+	server := newTestTransit(t)
+	defer server.Close()
+	t.Setenv(VaultAddrVar, server.URL)
+	t.Setenv(VaultTokenVar, "")
+	t.Setenv(VaultRoleIDVar, "role")
+	t.Setenv(VaultSecretIDVar, "secret")
+
+	client := NewVaultKMS("sctl")
+	cypher, err := client.Encrypt(context.Background(), []byte("hello"))
+	assert.NoError(t, err)
+
+	decrypted, err := client.Decrypt(context.Background(), cypher)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decrypted)
+}
+
+func TestVaultKMSErrors(t *testing.T) {
+	server := newTestTransit(t)
+	defer server.Close()
+	t.Setenv(VaultAddrVar, server.URL)
+	t.Setenv(VaultTokenVar, "")
+	t.Setenv(VaultRoleIDVar, "")
+
+	// No credentials at all
+	_, err := NewVaultKMS("sctl").Encrypt(context.Background(), []byte("hello"))
+	assert.Error(t, err)
+
+	// Bad AppRole credentials
+	t.Setenv(VaultRoleIDVar, "role")
+	t.Setenv(VaultSecretIDVar, "wrong")
+	_, err = NewVaultKMS("sctl").Encrypt(context.Background(), []byte("hello"))
+	assert.EqualError(t, err, "vault auth/approle/login returned 400: invalid role or secret ID")
+
+	// Bad token
+	t.Setenv(VaultTokenVar, "s.wrong")
+	_, err = NewVaultKMS("sctl").Encrypt(context.Background(), []byte("hello"))
+	assert.Error(t, err)
+
+	// Unknown key
+	t.Setenv(VaultTokenVar, testVaultToken)
+	_, err = NewVaultKMS("missing").Encrypt(context.Background(), []byte("hello"))
+	assert.Error(t, err)
+
+	// Bad ciphertext
+	_, err = NewVaultKMS("sctl").Decrypt(context.Background(), []byte("vault:v1:other"))
+	assert.Error(t, err)
+}
@@ -2,11 +2,14 @@ package commands
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
@@ -18,6 +21,7 @@ import (
 	"github.com/urfave/cli"
 	"github.com/vapor-ware/sctl/cloud"
 	"github.com/vapor-ware/sctl/credentials"
+	"github.com/vapor-ware/sctl/shamir"
 	"github.com/vapor-ware/sctl/utils"
 	"github.com/vapor-ware/sctl/version"
 )
@@ -25,6 +29,9 @@ import (
 const statecategory = "State management"
 const quickcategory = "Quick encrypt"
 
+// stdin is where commands read piped input from. Output is written to the app's Writer.
+var stdin = os.Stdin
+
 // BuildContextualMenu - Assemble the CLI commands, subcommands, and flags
 // Handles the majority of the CLI interface.
 // Returns an array of cli.Command configuration
@@ -44,9 +51,15 @@ func BuildContextualMenu() []cli.Command {
 					Name:  "no-decode",
 					Usage: "When reading the secret, do not base64 decode",
 				},
+				cli.StringSliceFlag{
+					Name:   "recipient",
+					EnvVar: "SCTL_RECIPIENTS",
+					Usage:  "Recipient KMS Key URI the envelope is expected to list, when its integrity MAC can not be verified (repeatable)",
+				},
+				allowUnsealedFlag,
 				cli.StringFlag{
 					Name:   "envelope, e",
-					Usage:  "Filepath to envelope",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
 					EnvVar: "SCTL_ENVELOPE",
 					Value:  ".scuttle.json",
 				},
@@ -58,13 +71,17 @@ func BuildContextualMenu() []cli.Command {
 					return ctxerr
 				}
 
-				// Check for KMS key uri, and presence of the secrets name
+				// Check for a KMS key uri before prompting for the secret. The key it is sealed
+				// with is taken from the envelope once it is locked, below.
 				var err error
-				var keyURI string
-
-				_, keyURI, err = utils.ReadSecrets(c.String("envelope"))
-				if err != nil {
-					return err
+				if c.String("key") == "" {
+					envelope, err := utils.ReadEnvelope(c.String("envelope"))
+					if err != nil {
+						return err
+					}
+					if envelope.KeyIdentifier == "" {
+						return errors.New("missing configuration for key")
+					}
 				}
 
 				var plaintext []byte
@@ -105,39 +122,50 @@ func BuildContextualMenu() []cli.Command {
 					plaintext = []byte(base64.StdEncoding.EncodeToString(plaintext))
 				}
 
-				// Work with the envelope's provided key or switch to CLI flags/env
-				var client cloud.KMS
-				if keyURI == "" {
-					// If no key URI is found in an existing scuttle config, check that the 'key' flag
-					// was set, either through command line or env var.
-					key := c.String("key")
-					if key == "" {
-						return errors.New("missing configuration for key")
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				return utils.UpdateEnvelope(c.String("envelope"), func(envelope *utils.V2) error {
+					if c.Bool("allow-unsealed") {
+						envelope.AllowUnsealed()
 					}
+					if err := envelope.CheckSealed(); err != nil {
+						return err
+					}
+					// Work with the envelope's provided key or switch to CLI flags/env
+					keyURI := envelope.KeyIdentifier
+					if keyURI == "" {
+						// If no key URI is found in an existing scuttle config, check that the 'key' flag
+						// was set, either through command line or env var.
+						keyURI = c.String("key")
+						if keyURI == "" {
+							return errors.New("missing configuration for key")
+						}
+					} else {
+						log.Debugf("Found Key Identifier: %s", keyURI)
+					}
+					// The secret is sealed for the envelope's key and every recipient
+					if err := confirmRecipients(*envelope, c.StringSlice("recipient")); err != nil {
+						return err
+					}
+					keys, err := newKeyring(keyURI, envelope.Recipients)
+					if err != nil {
+						return err
+					}
+					defer keys.Close()
 
-					client = cloud.NewGCPKMS(key)
-					// This ensures the final addSecret will consume the configuration
-					// key should we fall down to that case
-					keyURI = key
-				} else {
-					log.Debugf("Found Key Identifier: %s", keyURI)
-					client = cloud.NewGCPKMS(keyURI)
-				}
-
-				cypher, err := client.Encrypt(plaintext)
-				if err != nil {
-					return err
-				}
-				// re-encode the binary data we got back.
-				encoded := base64.StdEncoding.EncodeToString(cypher)
-				toAdd := utils.Secret{
-					Name:       strings.ToUpper(secretName),
-					Cyphertext: encoded,
-					Created:    time.Now(),
-					Encoding:   secretEncoding,
-				}
-
-				return utils.AddSecret(toAdd, keyURI, true, c.String("envelope"))
+					toAdd, err := encryptSecret(ctx, keys, envelope.ID, secretName, plaintext, secretEncoding)
+					if err != nil {
+						return err
+					}
+					if previous, err := envelope.Secrets.Find(toAdd.Name); err == nil {
+						toAdd = toAdd.Replacing(previous, envelope.GetHistoryDepth())
+					} else {
+						toAdd.Metadata = utils.NewMetadata(toAdd.Created, utils.CurrentUser())
+					}
+					envelope.KeyIdentifier = keyURI
+					envelope.Secrets.Add(toAdd)
+					return nil
+				})
 			},
 		},
 		{
@@ -224,13 +252,84 @@ func BuildContextualMenu() []cli.Command {
 					if err != nil {
 						return err
 					}
-					client := cloud.NewGCPKMS(c.String("key"))
-					cypher, err := client.Decrypt(decoded)
+					client, err := cloud.NewKMS(c.String("key"))
+					if err != nil {
+						return err
+					}
+					defer client.Close()
+
+					ctx, cancel := commandContext(c)
+					defer cancel()
+					cypher, err := client.Decrypt(ctx, decoded)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintln(c.App.Writer, string(cypher))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "Compare two envelopes, reporting which secrets were added, removed or rotated",
+			ArgsUsage: "[OLD] [NEW]",
+			Description: "Envelopes are given as a path, a URL, or git:REV:PATH to read one from git, with PATH\n" +
+				"   as git show takes it. OLD defaults to the envelope at git:HEAD, and NEW to the envelope.",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "decrypt",
+					Usage: "Decrypt changed secrets, showing their values masked",
+				},
+				cli.BoolFlag{
+					Name:  "reveal",
+					Usage: "With --decrypt, show changed values in full",
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() > 2 {
+					return errors.New("expected at most two envelopes to compare")
+				}
+				oldSource, newSource := c.Args().Get(0), c.Args().Get(1)
+				if newSource == "" {
+					newSource = c.String("envelope")
+				}
+				if oldSource == "" {
+					if strings.Contains(newSource, "://") || filepath.IsAbs(newSource) {
+						return errors.New("no envelope to compare with - give both OLD and NEW")
+					}
+					oldSource = gitSourcePrefix + "HEAD:./" + filepath.ToSlash(newSource)
+				}
+				if c.Bool("reveal") && !c.Bool("decrypt") {
+					return errors.New("--reveal requires --decrypt")
+				}
+
+				previous, err := loadDiffSource(oldSource)
+				if err != nil {
+					return err
+				}
+				current, err := loadDiffSource(newSource)
+				if err != nil {
+					return err
+				}
+				changes := diffSecrets(previous.Secrets, current.Secrets)
+
+				var values diffValues
+				if c.Bool("decrypt") {
+					ctx, cancel := commandContext(c)
+					defer cancel()
+					values, err = decryptChanges(ctx, previous, current, changes)
 					if err != nil {
 						return err
 					}
-					fmt.Println(string(cypher))
 				}
+				printDiff(c.App.Writer, changes, values, c.Bool("reveal"))
 				return nil
 			},
 		},
@@ -267,16 +366,141 @@ func BuildContextualMenu() []cli.Command {
 					return errors.New("empty input detected - aborting")
 				}
 
-				client := cloud.NewGCPKMS(c.String("key"))
-				cypher, err := client.Encrypt(plaintext)
+				client, err := cloud.NewKMS(c.String("key"))
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				cypher, err := client.Encrypt(ctx, plaintext)
 				if err != nil {
 					return err
 				}
 				encoded := base64.StdEncoding.EncodeToString(cypher)
 
-				fmt.Println("```")
-				fmt.Printf("sctl decrypt --key=%s %s\n", c.String("key"), encoded)
-				fmt.Println("```")
+				fmt.Fprintln(c.App.Writer, "```")
+				fmt.Fprintf(c.App.Writer, "sctl decrypt --key=%s %s\n", c.String("key"), encoded)
+				fmt.Fprintln(c.App.Writer, "```")
+				return nil
+			},
+		},
+		{
+			Name:     "fmt",
+			Usage:    "Rewrite the envelope in its canonical form, with secrets sorted by name",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "Fail if the envelope is not canonical, without rewriting it",
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				changed, err := utils.FormatEnvelope(c.String("envelope"), c.Bool("check"))
+				switch {
+				case err != nil:
+					return err
+				case changed && c.Bool("check"):
+					return fmt.Errorf("envelope %s is not canonical - rewrite it with: sctl fmt", c.String("envelope"))
+				case changed:
+					fmt.Fprintf(c.App.Writer, "Formatted %s\n", c.String("envelope"))
+				}
+				return nil
+			},
+		},
+		{
+			Name:     "git",
+			Usage:    "Integrate envelopes with git",
+			Category: statecategory,
+			Subcommands: []cli.Command{
+				{
+					Name:  "install",
+					Usage: "Register sctl as the merge driver for envelopes in the current git repository",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "pattern",
+							Usage: "The .gitattributes pattern matching envelopes",
+							Value: ".scuttle.json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if err := installMergeDriver(c.String("pattern")); err != nil {
+							return err
+						}
+						fmt.Fprintf(c.App.Writer, "Registered the sctl merge driver for %s\n", c.String("pattern"))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "List the versions of a named secret, or set how many are kept",
+			ArgsUsage: "NAME",
+			Category:  statecategory,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "depth",
+					Usage: fmt.Sprintf("Set the number of previous versions kept for each secret in the envelope (default %d)", utils.DefaultHistoryDepth),
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.IsSet("depth") {
+					if c.NArg() != 0 {
+						return errors.New("usage: sctl history --depth N")
+					}
+					return utils.UpdateEnvelope(c.String("envelope"), func(envelope *utils.V2) error {
+						return envelope.SetHistoryDepth(c.Int("depth"))
+					})
+				}
+				if c.NArg() != 1 {
+					return errors.New("usage: sctl history NAME")
+				}
+
+				envelope, err := utils.ReadEnvelope(c.String("envelope"))
+				if err != nil {
+					return err
+				}
+				secret, err := envelope.Secrets.Find(strings.ToUpper(c.Args().First()))
+				if err != nil {
+					return err
+				}
+				printHistory(c.App.Writer, secret)
+				return nil
+			},
+		},
+		{
+			Name:     "keygen",
+			Usage:    "Generate a local key file for offline encryption",
+			Category: quickcategory,
+			Action: func(c *cli.Context) error {
+				err := validateContext(c, "keygen")
+				if err != nil {
+					return err
+				}
+				// The key URI is stored in envelopes, so must not depend on the working directory
+				keyfile, err := filepath.Abs(c.Args().First())
+				if err != nil {
+					return err
+				}
+				err = cloud.GenerateLocalKey(keyfile)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(c.App.Writer, "Generated local key. Use it with --key=%s%s\n", cloud.LocalScheme, keyfile)
 				return nil
 			},
 		},
@@ -287,7 +511,7 @@ func BuildContextualMenu() []cli.Command {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "envelope, e",
-					Usage:  "Filepath to envelope",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
 					EnvVar: "SCTL_ENVELOPE",
 					Value:  ".scuttle.json",
 				},
@@ -303,8 +527,170 @@ func BuildContextualMenu() []cli.Command {
 				}
 				sort.Strings(knownKeys)
 				for i, k := range knownKeys {
-					fmt.Printf("%d] %s\n", i, k)
+					fmt.Fprintf(c.App.Writer, "%d] %s\n", i, k)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "merge-driver",
+			Usage:     "Merge two versions of an envelope secret by secret, as a git merge driver",
+			ArgsUsage: "BASE OURS THEIRS",
+			Description: "Secrets added, removed or changed on one side are taken from that side, and only secrets\n" +
+				"   changed differently on both sides conflict. The merged envelope is written to OURS, which\n" +
+				"   is left untouched on a conflict. Register it with: sctl git install",
+			Category: statecategory,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 3 {
+					return errors.New("expected the BASE, OURS and THEIRS envelopes, as git passes %O %A %B")
+				}
+				var sides [3]utils.V2
+				for i, path := range c.Args() {
+					envelope, err := readMergeSide(path)
+					if err != nil {
+						return err
+					}
+					sides[i] = envelope
+				}
+				// Their changes are only sealed into ours when both sides verify. Otherwise the
+				// merged envelope keeps our MAC, for a holder of its key to review and reseal.
+				if verifiedSide(&sides[2]) {
+					verifiedSide(&sides[1])
+				}
+				merged, conflicts, err := mergeEnvelopes(sides[0], sides[1], sides[2])
+				if err != nil {
+					return err
+				}
+				if len(conflicts) > 0 {
+					return fmt.Errorf("unable to merge envelopes:\n  %s", strings.Join(conflicts, "\n  "))
+				}
+
+				ours := c.Args().Get(1)
+				merged.Filepath = ours
+				if err := merged.Save(); err != nil {
+					return err
+				}
+				// git keeps its own copy of OURS, so the backup would only litter the work tree
+				if err := os.Remove(ours + utils.BackupSuffix); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			Name:     "meta",
+			Usage:    "View and edit secret metadata",
+			Category: statecategory,
+			Subcommands: []cli.Command{
+				{
+					Name:      "get",
+					Usage:     "Display the metadata of a named secret",
+					ArgsUsage: "NAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "envelope, e",
+							EnvVar: "SCTL_ENVELOPE",
+							Usage:  "Filepath or URL (gs://, https://) to envelope",
+							Value:  ".scuttle.json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return errors.New("usage: sctl meta get NAME")
+						}
+						envelope, err := utils.ReadEnvelope(c.String("envelope"))
+						if err != nil {
+							return err
+						}
+						secret, err := envelope.Secrets.Find(strings.ToUpper(c.Args().First()))
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(c.App.Writer, "created=%s\n", secret.Created.Format(time.RFC3339))
+						for _, entry := range secret.MetadataEntries() {
+							fmt.Fprintln(c.App.Writer, entry)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Set metadata of a named secret: " + strings.Join(utils.MetadataKeys, ", "),
+					ArgsUsage: "NAME key=value [key=value...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "envelope, e",
+							EnvVar: "SCTL_ENVELOPE",
+							Usage:  "Filepath or URL (gs://, https://) to envelope",
+							Value:  ".scuttle.json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 2 {
+							return errors.New("usage: sctl meta set NAME key=value [key=value...]")
+						}
+						name := strings.ToUpper(c.Args().First())
+						return utils.UpdateEnvelope(c.String("envelope"), func(envelope *utils.V2) error {
+							for i := range envelope.Secrets {
+								if envelope.Secrets[i].Name != name {
+									continue
+								}
+								for _, arg := range c.Args().Tail() {
+									key, value, found := strings.Cut(arg, "=")
+									if !found {
+										return fmt.Errorf("invalid metadata %q - expected key=value", arg)
+									}
+									if err := envelope.Secrets[i].SetMetadata(key, value); err != nil {
+										return err
+									}
+								}
+								return nil
+							}
+							return fmt.Errorf("Secret %s not found", name)
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:     "migrate",
+			Usage:    "Upgrade an envelope to the current format version",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "key",
+					EnvVar: "SCTL_KEY",
+					Usage:  "KMS Key URI, for envelopes that do not record one",
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var from string
+				err := utils.UpdateEnvelope(c.String("envelope"), func(envelope *utils.V2) error {
+					if len(envelope.Secrets) == 0 && envelope.KeyIdentifier == "" {
+						return fmt.Errorf("no envelope found at %s", c.String("envelope"))
+					}
+					from = envelope.Version
+					if from == "" {
+						from = "1"
+					}
+					migrateEnvelope(envelope, c.String("key"))
+					// An envelope without a MAC is sealed with one. A sealed envelope keeps its
+					// MAC, and is only resealed if it verifies.
+					if envelope.Integrity == nil {
+						envelope.Reseal()
+					}
+					return nil
+				})
+				if err != nil {
+					return err
 				}
+				fmt.Fprintf(c.App.Writer, "Migrated %s from version %s to %s\n", c.String("envelope"), from, utils.CurrentVersion)
 				return nil
 			},
 		},
@@ -321,13 +707,18 @@ func BuildContextualMenu() []cli.Command {
 				cli.StringFlag{
 					Name:   "envelope, e",
 					EnvVar: "SCTL_ENVELOPE",
-					Usage:  "Filepath to envelope",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
 					Value:  ".scuttle.json",
 				},
 				cli.BoolFlag{
 					Name:  "no-decode",
 					Usage: "When reading the secret, do not base64 decode",
 				},
+				cli.IntFlag{
+					Name:  "version",
+					Usage: "Read a previous version of the secret, as listed by history",
+				},
+				allowUnsealedFlag,
 			},
 			Action: func(c *cli.Context) error {
 				// read context check only cares about the argument as a parameter
@@ -337,10 +728,14 @@ func BuildContextualMenu() []cli.Command {
 					return ctxerr
 				}
 
-				secrets, keyURI, err := utils.ReadSecrets(c.String("envelope"))
+				envelope, err := utils.ReadEnvelope(c.String("envelope"))
 				if err != nil {
 					return err
 				}
+				if err := verifyEnvelope(c, &envelope); err != nil {
+					return err
+				}
+				secrets, keyURI := envelope.Secrets, envelope.KeyIdentifier
 
 				searchTerm := c.Args().First()
 
@@ -361,36 +756,43 @@ func BuildContextualMenu() []cli.Command {
 				if findErr != nil {
 					return findErr
 				}
-
-				// uncan the base64
-				decoded, err := base64.StdEncoding.DecodeString(locatedSecret.Cyphertext)
-				if err != nil {
-					return errors.Wrap(err, "failed secret decode")
+				if c.IsSet("version") {
+					locatedSecret, findErr = locatedSecret.FindVersion(c.Int("version"))
+					if findErr != nil {
+						return findErr
+					}
 				}
+
 				// Work with the envelope's provided key or switch to CLI flags/env
-				var client cloud.KMS
 				if keyURI == "" {
 					log.Debug("No KeyURI found in envelope. Required usage of flag/env for SCTL_KEY.")
 					// use the switch-case to ensure we have a key set in this context
-					err := validateContext(c, "default")
+					err = validateContext(c, "default")
 					if err != nil {
 						return err
 					}
-					client = cloud.NewGCPKMS(c.String("key"))
+					keyURI = c.String("key")
 				} else {
 					log.Debug("Found Key Identifier: ", keyURI)
-					client = cloud.NewGCPKMS(keyURI)
 				}
-				cypher, err := client.Decrypt(decoded)
+				keys, err := newKeyring(keyURI, envelope.Recipients)
 				if err != nil {
-					return errors.Wrap(err, "failed secret decrypt")
+					return err
+				}
+				defer keys.Close()
+
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				cypher, err := decryptSecret(ctx, keys, envelope.ID, locatedSecret)
+				if err != nil {
+					return err
 				}
 
 				// short-circuit the base64 decoding and return our base64 encoded cyphertext by request
 				// of the user.
 				if c.Bool("no-decode") {
 					log.Debugf("skipping decode of %v due to --no-decode", locatedSecret.Name)
-					fmt.Println(string(cypher))
+					fmt.Fprintln(c.App.Writer, string(cypher))
 					return nil
 				}
 
@@ -404,105 +806,281 @@ func BuildContextualMenu() []cli.Command {
 					log.Debugf("skipping decode of %v due to encoding != base64", locatedSecret.Name)
 				}
 
-				fmt.Println(string(cypher))
+				fmt.Fprintln(c.App.Writer, string(cypher))
 
 				return nil
 			},
 		},
 		{
-			Name:     "rekey",
-			Usage:    "Re-encrypt a statefile to a new key-version",
+			Name:     "recovery",
+			Usage:    "Manage the break-glass recovery key of an envelope",
 			Category: statecategory,
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:   "key",
-					EnvVar: "SCTL_KEY",
-					Usage:  "KMS Key URI",
-				},
-				cli.StringFlag{
-					Name:  "newkey",
-					Usage: "New KMS Key URI (optional)",
-				},
-				cli.StringFlag{
-					Name:   "envelope, e",
-					EnvVar: "SCTL_ENVELOPE",
-					Usage:  "Filepath to envelope",
-					Value:  ".scuttle.json",
-				},
-			},
-			Action: func(c *cli.Context) error {
-				var sctlKey string
-				newKey := c.String("newkey")
+			Subcommands: []cli.Command{
+				{
+					Name:  "init",
+					Usage: "Seal every secret for a new recovery key split into shares",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "key",
+							EnvVar: "SCTL_KEY",
+							Usage:  "KMS Key URI",
+						},
+						cli.IntFlag{
+							Name:  "shares",
+							Usage: "Number of shares to split the recovery key into",
+							Value: 5,
+						},
+						cli.IntFlag{
+							Name:  "threshold",
+							Usage: "Number of shares required to unseal the recovery key",
+							Value: 3,
+						},
+						concurrencyFlag,
+						cli.StringFlag{
+							Name:   "envelope, e",
+							EnvVar: "SCTL_ENVELOPE",
+							Usage:  "Filepath or URL (gs://, https://) to envelope",
+							Value:  ".scuttle.json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						privateKey, recoveryURI, err := cloud.GenerateRecoveryKey()
+						if err != nil {
+							return err
+						}
+						shares, err := shamir.Split(privateKey, c.Int("shares"), c.Int("threshold"))
+						scrub(privateKey)
+						if err != nil {
+							return err
+						}
 
-				secrets, keyURI, err := utils.ReadSecrets(c.String("envelope"))
-				if err != nil {
-					return err
-				}
+						keyrings := func(envelope utils.V2) (*keyring, *keyring, error) {
+							keyURI := envelope.KeyIdentifier
+							if keyURI == "" {
+								if err := validateContext(c, "default"); err != nil {
+									return nil, nil, err
+								}
+								keyURI = c.String("key")
+							}
+							if existing := recoveryRecipient(envelope); existing != "" {
+								return nil, nil, fmt.Errorf("envelope already has a recovery key - remove it first with: sctl rekey --remove-recipient %s", existing)
+							}
+							keys, err := newKeyring(keyURI, envelope.Recipients)
+							if err != nil {
+								return nil, nil, err
+							}
+							newKeys, err := newKeyring(keyURI, updateRecipients(keyURI, envelope.Recipients, []string{recoveryURI}, nil))
+							if err != nil {
+								keys.Close()
+								return nil, nil, err
+							}
+							return keys, newKeys, nil
+						}
 
-				if keyURI == "" {
-					log.Debug("No KeyURI found in envelope. Using flag/env for SCTL_KEY.")
-					sctlKey = c.String("key")
-				} else {
-					log.Debug("Using key found in envelope: ", keyURI)
-					sctlKey = keyURI
-				}
+						ctx, cancel := commandContext(c)
+						defer cancel()
+						_, err = rekeyEnvelope(ctx, c.String("envelope"), keyrings, rekeyOptions{concurrency: c.Int("concurrency")})
+						if err != nil {
+							return err
+						}
 
-				client := cloud.NewGCPKMS(sctlKey)
-				for _, secret := range secrets {
-					// uncan the base64
-					decoded, err := base64.StdEncoding.DecodeString(secret.Cyphertext)
-					if err != nil {
-						return errors.Wrap(err, "failed secret decode")
-					}
-					decrypted, err := client.Decrypt(decoded)
-					if err != nil {
-						return errors.Wrap(err, "failed secret decrypt")
-					}
+						fmt.Fprintf(c.App.Writer, "Sealed every secret for recovery key %s\n", recoveryURI)
+						fmt.Fprintf(c.App.Writer, "Any %d of these %d shares unseal it. Give each share to a different custodian.\n\n", c.Int("threshold"), len(shares))
+						for i, share := range shares {
+							fmt.Fprintf(c.App.Writer, "share %d: %s\n", i+1, hex.EncodeToString(share))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "unseal",
+					Usage: "Decrypt an envelope with recovery shares read from STDIN, without the KMS",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "newkey",
+							Usage: "Re-key the envelope to this KMS Key URI instead of printing the secrets",
+						},
+						concurrencyFlag,
+						cli.StringFlag{
+							Name:   "envelope, e",
+							EnvVar: "SCTL_ENVELOPE",
+							Usage:  "Filepath or URL (gs://, https://) to envelope",
+							Value:  ".scuttle.json",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						input, err := stdinScan()
+						if err != nil {
+							return err
+						}
+						if input == nil {
+							input, err = utils.UserInput("Enter the recovery shares, one per line")
+							if err != nil {
+								return err
+							}
+						}
+						shares, err := parseShares(input)
+						if err != nil {
+							return err
+						}
+						privateKey, err := shamir.Combine(shares)
+						if err != nil {
+							return err
+						}
+						client, recoveryURI, err := cloud.UnsealRecoveryKey(privateKey)
+						scrub(privateKey)
+						if err != nil {
+							return err
+						}
+						defer client.Close()
 
-					if newKey != "" {
-						// Init a KMS client
-						newClient := cloud.NewGCPKMS(newKey)
+						ctx, cancel := commandContext(c)
+						defer cancel()
+						if newKey := c.String("newkey"); newKey != "" {
+							keyrings := func(envelope utils.V2) (*keyring, *keyring, error) {
+								if recoveryURI != recoveryRecipient(envelope) {
+									return nil, nil, errUnsealShares
+								}
+								newKeys, err := newKeyring(newKey, updateRecipients(newKey, envelope.Recipients, nil, nil))
+								if err != nil {
+									return nil, nil, err
+								}
+								return newRecoveryKeyring(envelope.KeyIdentifier, recoveryURI, client), newKeys, nil
+							}
+							_, err = rekeyEnvelope(ctx, c.String("envelope"), keyrings, rekeyOptions{concurrency: c.Int("concurrency")})
+							return err
+						}
 
-						newCypher, err := newClient.Encrypt(decrypted)
+						envelope, err := utils.ReadEnvelope(c.String("envelope"))
 						if err != nil {
 							return err
 						}
-						// re-encode the binary data we got back.
-						encoded := base64.StdEncoding.EncodeToString(newCypher)
-						toAdd := utils.Secret{
-							Name:       strings.ToUpper(secret.Name),
-							Cyphertext: encoded,
-							Created:    time.Now(),
-							Encoding:   secret.Encoding,
+						if recoveryURI != recoveryRecipient(envelope) {
+							return errUnsealShares
+						}
+						// The integrity key is not wrapped for the public recovery key, so the envelope
+						// is only verified while its own key remains
+						if !envelope.Verified() {
+							log.Warnf("Envelope %s could not be verified, so its secrets may have been changed outside of sctl", envelope.Filepath)
 						}
-						log.Debug("Saving new secret: ", toAdd.Name, " With key: ", newKey)
-						// ReKeying with a new secret is an explicit process. Invoke addSecret without
-						// key validation
-						err = utils.AddSecret(toAdd, newKey, false, c.String("envelope"))
+						keys := newRecoveryKeyring(envelope.KeyIdentifier, recoveryURI, client)
+
+						decrypted, err := mapSecrets(envelope.Secrets, c.Int("concurrency"), func(secret utils.Secret) ([]byte, error) {
+							return decryptSecret(ctx, keys, envelope.ID, secret)
+						})
 						if err != nil {
 							return err
 						}
-						continue
+						for i, secret := range envelope.Secrets {
+							plaintext, err := decodeSecret(secret, decrypted[i])
+							if err != nil {
+								return err
+							}
+							fmt.Fprintf(c.App.Writer, "%s=%s\n", secret.Name, plaintext)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:     "rekey",
+			Usage:    "Re-encrypt a statefile to a new key-version",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "key",
+					EnvVar: "SCTL_KEY",
+					Usage:  "KMS Key URI",
+				},
+				cli.StringFlag{
+					Name:  "newkey",
+					Usage: "New KMS Key URI (optional)",
+				},
+				cli.StringSliceFlag{
+					Name:  "add-recipient",
+					Usage: "Additional KMS Key URI to seal every secret for (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "remove-recipient",
+					Usage: "Recipient KMS Key URI to stop sealing secrets for (repeatable)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Re-key and verify every secret, and report what would change without saving",
+				},
+				cli.BoolFlag{
+					Name:  "only-stale",
+					Usage: "Only re-encrypt secrets not sealed with the key's primary version",
+				},
+				concurrencyFlag,
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				newKey := c.String("newkey")
+				added := c.StringSlice("add-recipient")
+				removed := c.StringSlice("remove-recipient")
+				if c.Bool("only-stale") && (newKey != "" || len(added) > 0 || len(removed) > 0) {
+					return errors.New("--only-stale can not be combined with a change of key or recipients")
+				}
+
+				var targetKey string
+				var current, recipients []string
+				keyrings := func(envelope utils.V2) (*keyring, *keyring, error) {
+					sctlKey := envelope.KeyIdentifier
+					if sctlKey == "" {
+						log.Debug("No KeyURI found in envelope. Using flag/env for SCTL_KEY.")
+						sctlKey = c.String("key")
+					} else {
+						log.Debug("Using key found in envelope: ", sctlKey)
 					}
 
-					newCypher, err := client.Encrypt(decrypted)
+					// Any of the current keys may unwrap the data keys, so an envelope whose
+					// key was lost can be re-keyed with one of its recipients.
+					keys, err := newKeyring(sctlKey, envelope.Recipients)
 					if err != nil {
-						return err
+						return nil, nil, err
 					}
-					// re-encode the binary data we got back.
-					encoded := base64.StdEncoding.EncodeToString(newCypher)
 
-					toAdd := utils.Secret{
-						Name:       strings.ToUpper(secret.Name),
-						Cyphertext: encoded,
-						Created:    time.Now(),
-						Encoding:   secret.Encoding,
+					// Re-keying in place re-encrypts with the same key.
+					targetKey = sctlKey
+					if newKey != "" {
+						targetKey = newKey
 					}
-
-					err = utils.AddSecret(toAdd, sctlKey, true, c.String("envelope"))
+					current = envelope.Recipients
+					recipients = updateRecipients(targetKey, envelope.Recipients, added, removed)
+					newKeys, err := newKeyring(targetKey, recipients)
 					if err != nil {
-						return err
+						keys.Close()
+						return nil, nil, err
 					}
+					return keys, newKeys, nil
+				}
+
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				rekeyed, err := rekeyEnvelope(ctx, c.String("envelope"), keyrings, rekeyOptions{
+					concurrency: c.Int("concurrency"),
+					// A removed recipient may still hold the old data keys, so secrets are
+					// sealed under new data keys rather than re-wrapped.
+					reseal:    len(removed) > 0,
+					onlyStale: c.Bool("only-stale"),
+					dryRun:    c.Bool("dry-run"),
+				})
+				if err != nil || !c.Bool("dry-run") {
+					return err
+				}
+				fmt.Fprintf(c.App.Writer, "Would re-key %d secrets to %s\n", len(rekeyed), targetKey)
+				for _, name := range rekeyed {
+					fmt.Fprintf(c.App.Writer, "  %s\n", name)
+				}
+				if strings.Join(recipients, ",") != strings.Join(current, ",") {
+					fmt.Fprintf(c.App.Writer, "Would set recipients to: %s\n", strings.Join(recipients, ", "))
 				}
 				return nil
 			},
@@ -515,7 +1093,7 @@ func BuildContextualMenu() []cli.Command {
 				cli.StringFlag{
 					Name:   "envelope, e",
 					EnvVar: "SCTL_ENVELOPE",
-					Usage:  "Filepath to envelope",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
 					Value:  ".scuttle.json",
 				},
 			},
@@ -524,6 +1102,48 @@ func BuildContextualMenu() []cli.Command {
 				return utils.DeleteSecret(secretName, c.String("envelope"))
 			},
 		},
+		{
+			Name:      "rollback",
+			Usage:     "Restore a previous version of a named secret",
+			ArgsUsage: "NAME",
+			Category:  statecategory,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "to",
+					Usage: "Version to restore, as listed by history",
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 || !c.IsSet("to") {
+					return errors.New("usage: sctl rollback NAME --to VERSION")
+				}
+				name := strings.ToUpper(c.Args().First())
+				var restored utils.Secret
+				err := utils.UpdateEnvelope(c.String("envelope"), func(envelope *utils.V2) error {
+					secret, err := envelope.Secrets.Find(name)
+					if err != nil {
+						return err
+					}
+					restored, err = secret.RollingBack(c.Int("to"), time.Now(), envelope.GetHistoryDepth())
+					if err != nil {
+						return err
+					}
+					envelope.Secrets.Add(restored)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(c.App.Writer, "Restored version %d of %s as version %d\n", c.Int("to"), name, restored.Version)
+				return nil
+			},
+		},
 		{
 			Name:           "run",
 			Usage:          "Run a command with secrets exported as env",
@@ -539,18 +1159,19 @@ func BuildContextualMenu() []cli.Command {
 					Name:  "interactive, i",
 					Usage: "Run the command in an interactive session",
 				},
+				concurrencyFlag,
 				cli.StringFlag{
 					Name:   "envelope, e",
 					EnvVar: "SCTL_ENVELOPE",
-					Usage:  "Filepath to envelope",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
 					Value:  ".scuttle.json",
 				},
+				allowUnsealedFlag,
 			},
 			Action: func(c *cli.Context) error {
 
-				var secrets []utils.Secret
+				var envelope utils.V2
 				var arguments []string = c.Args()
-				var keyURI string
 				// TODO: Not real crazy about this pattern but we have to satisfy
 				// moving the validateContext() into the path-evaluation below
 				var err error
@@ -558,67 +1179,174 @@ func BuildContextualMenu() []cli.Command {
 				cmd := exec.Command(arguments[0], arguments[1:]...)
 				cmd.Env = os.Environ()
 				// TODO: Clean this up and handle the error case.
-				secrets, keyURI, err = utils.ReadSecrets(c.String("envelope"))
+				envelope, err = utils.ReadEnvelope(c.String("envelope"))
 				if err != nil {
 					return err
 				}
-				for _, secret := range secrets {
-					// uncan the base64
-					decoded, err := base64.StdEncoding.DecodeString(secret.Cyphertext)
-					if err != nil {
-						return errors.Wrap(err, "failed secret decode")
-					}
-					// Work with the envelope's provided key or switch to CLI flags/env
-					var client cloud.KMS
+				if err := verifyEnvelope(c, &envelope); err != nil {
+					return err
+				}
+				secrets, keyURI := envelope.Secrets, envelope.KeyIdentifier
+				// Work with the envelope's provided key or switch to CLI flags/env. A single
+				// keyring is shared to decrypt every secret in the envelope.
+				var keys *keyring
+				if len(secrets) > 0 {
 					if keyURI == "" {
 						log.Debug("No KeyURI found in envelope. Required usage of flag/env for SCTL_KEY.")
-						err := validateContext(c, "run")
+						err = validateContext(c, "run")
 						if err != nil {
 							return err
 						}
-						client = cloud.NewGCPKMS(c.String("key"))
+						keyURI = c.String("key")
 					} else {
 						log.Debug("Found Key Identifier: ", keyURI)
-						client = cloud.NewGCPKMS(keyURI)
 					}
-					cypher, err := client.Decrypt(decoded)
+					keys, err = newKeyring(keyURI, envelope.Recipients)
 					if err != nil {
-						return errors.Wrap(err, "failed secret decrypt")
+						return err
 					}
-					// switch output if encoding == base64
-					if secret.Encoding == "base64" {
-						cypher, err = base64.StdEncoding.DecodeString(string(cypher))
-						if err != nil {
-							return errors.Wrap(err, "failed secret decode")
-						}
-					} else {
-						log.Debugf("skipping decode of %v due to encoding != base64", secret.Name)
+					defer keys.Close()
+				}
+				// The timeout bounds decryption only, not the command being run
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				decrypted, err := mapSecrets(secrets, c.Int("concurrency"), func(secret utils.Secret) ([]byte, error) {
+					return decryptSecret(ctx, keys, envelope.ID, secret)
+				})
+				if err != nil {
+					return err
+				}
+				for i, secret := range secrets {
+					cypher, err := decodeSecret(secret, decrypted[i])
+					if err != nil {
+						return err
 					}
 					// Format the decrypted data for ENV consumption
 					skrt := fmt.Sprintf("%s=%v", secret.Name, string(cypher))
 					// Append it to the command exec environment
 					cmd.Env = append(cmd.Env, skrt)
 				}
-				cmd.Stdout = os.Stdout
+				// Release the KMS connections before handing over to what may be a long running command
+				if keys != nil {
+					keys.Close()
+				}
+				cmd.Stdout = c.App.Writer
 				cmd.Stderr = os.Stderr
 				if c.Bool("interactive") {
-					cmd.Stdin = os.Stdin
+					cmd.Stdin = stdin
 				}
 				return cmd.Run()
 			},
 		},
+		{
+			Name:     "status",
+			Usage:    "List secrets grouped by the key version that sealed them",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "key",
+					EnvVar: "SCTL_KEY",
+					Usage:  "KMS Key URI",
+				},
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				envelope, err := utils.ReadEnvelope(c.String("envelope"))
+				if err != nil {
+					return err
+				}
+				keyURI := envelope.KeyIdentifier
+				if keyURI == "" {
+					keyURI = c.String("key")
+				}
+				if keyURI == "" {
+					return errors.New("no key found in the envelope, and --key was not given")
+				}
+
+				client, err := cloud.NewKMS(keyURI)
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+
+				ctx, cancel := commandContext(c)
+				defer cancel()
+				primary, err := primaryVersion(ctx, client)
+				if err != nil {
+					return err
+				}
+				printStatus(c.App.Writer, keyURI, primary, envelope.Secrets)
+				return nil
+			},
+		},
+		{
+			Name:     "verify",
+			Usage:    "Check the envelope's integrity MAC, failing if it is missing or does not match",
+			Category: statecategory,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reseal",
+					Usage: "Seal the envelope with a new MAC once its changes are reviewed, after decrypting every secret",
+				},
+				concurrencyFlag,
+				cli.StringFlag{
+					Name:   "envelope, e",
+					EnvVar: "SCTL_ENVELOPE",
+					Usage:  "Filepath or URL (gs://, https://) to envelope",
+					Value:  ".scuttle.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Bool("reseal") {
+					ctx, cancel := commandContext(c)
+					defer cancel()
+					var count int
+					err := utils.ResealEnvelope(c.String("envelope"), func(envelope utils.V2) error {
+						count = len(envelope.Secrets)
+						return reviewSecrets(ctx, envelope, c.Int("concurrency"))
+					})
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(c.App.Writer, "Resealed %d secrets in %s\n", count, c.String("envelope"))
+					return nil
+				}
+
+				envelope, err := utils.LoadEnvelope(c.String("envelope"))
+				if err != nil {
+					return err
+				}
+				envelope.Filepath = c.String("envelope")
+				if !envelope.Sealable() {
+					return fmt.Errorf("envelope %s is under key %s, which anyone able to see its public key may encrypt with, so it can not be sealed with an integrity MAC", c.String("envelope"), envelope.KeyIdentifier)
+				}
+				if envelope.Integrity == nil {
+					return fmt.Errorf("envelope %s has no integrity MAC - review it, then add one with: sctl migrate", c.String("envelope"))
+				}
+				if err := envelope.VerifyIntegrity(); err != nil {
+					return err
+				}
+				fmt.Fprintf(c.App.Writer, "Verified %d secrets in %s\n", len(envelope.Secrets), c.String("envelope"))
+				return nil
+			},
+		},
 		{
 			Name:           "bugreport",
 			Usage:          "Collect system information for filing a bug report",
 			SkipArgReorder: true,
 			Action: func(c *cli.Context) error {
-				fmt.Println("File a bug for scuttle here: https://github.com/vapor-ware/sctl/issues/new")
-				fmt.Println("Include the information below to provide better context around the issue:")
-				fmt.Println("")
-				fmt.Printf("version  : %s\n", c.App.Version)
-				fmt.Printf("arch     : %s\n", runtime.GOARCH)
-				fmt.Printf("os       : %s\n", runtime.GOOS)
-				fmt.Printf("compiler : %s\n", runtime.Compiler)
+				fmt.Fprintln(c.App.Writer, "File a bug for scuttle here: https://github.com/vapor-ware/sctl/issues/new")
+				fmt.Fprintln(c.App.Writer, "Include the information below to provide better context around the issue:")
+				fmt.Fprintln(c.App.Writer)
+				fmt.Fprintf(c.App.Writer, "version  : %s\n", c.App.Version)
+				fmt.Fprintf(c.App.Writer, "arch     : %s\n", runtime.GOARCH)
+				fmt.Fprintf(c.App.Writer, "os       : %s\n", runtime.GOOS)
+				fmt.Fprintf(c.App.Writer, "compiler : %s\n", runtime.Compiler)
 				return nil
 			},
 		},
@@ -627,13 +1355,13 @@ func BuildContextualMenu() []cli.Command {
 			Usage: "Print build and version info",
 			Action: func(c *cli.Context) error {
 				info := version.GetVersion()
-				fmt.Println("sctl")
-				fmt.Printf("  version    : %s\n", info.Version)
-				fmt.Printf("  build date : %s\n", info.BuildDate)
-				fmt.Printf("  git commit : %s\n", info.Commit)
-				fmt.Printf("  git tag    : %s\n", info.Tag)
-				fmt.Printf("  compiler   : %s\n", info.Compiler)
-				fmt.Printf("  platform   : %s/%s\n", info.OS, info.Arch)
+				fmt.Fprintln(c.App.Writer, "sctl")
+				fmt.Fprintf(c.App.Writer, "  version    : %s\n", info.Version)
+				fmt.Fprintf(c.App.Writer, "  build date : %s\n", info.BuildDate)
+				fmt.Fprintf(c.App.Writer, "  git commit : %s\n", info.Commit)
+				fmt.Fprintf(c.App.Writer, "  git tag    : %s\n", info.Tag)
+				fmt.Fprintf(c.App.Writer, "  compiler   : %s\n", info.Compiler)
+				fmt.Fprintf(c.App.Writer, "  platform   : %s/%s\n", info.OS, info.Arch)
 				return nil
 			},
 		},
@@ -654,6 +1382,11 @@ func validateContext(c *cli.Context, context string) error {
 		if c.Args().First() == "" {
 			return errors.New("usage: sctl read SECRET_ALIAS")
 		}
+	case "keygen":
+		// disallow empty key file path
+		if c.Args().First() == "" {
+			return errors.New("usage: sctl keygen PATH")
+		}
 	default:
 		if len(c.String("key")) == 0 {
 			return errors.New("missing configuration for key")
@@ -664,16 +1397,280 @@ func validateContext(c *cli.Context, context string) error {
 	return nil
 }
 
+// commandContext - build the context bounding KMS calls made by a command, honouring the
+// global --timeout flag. A zero timeout places no deadline on the calls.
+func commandContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	timeout := c.GlobalDuration("timeout")
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// rekeyOptions - how rekeyEnvelope moves an envelope's secrets to a new keyring
+type rekeyOptions struct {
+	// concurrency bounds the secrets re-keyed at once
+	concurrency int
+	// reseal seals every secret under a new data key, rather than re-wrapping the old one
+	reseal bool
+	// onlyStale limits re-keying to the secrets not sealed with the key's primary version
+	onlyStale bool
+	// dryRun re-keys and verifies the secrets without saving the envelope
+	dryRun bool
+}
+
+// rekeyKeyrings - build the keyrings an envelope is re-keyed from and to, given the envelope
+// as read while it is locked. Any error leaves no keyring open.
+type rekeyKeyrings func(envelope utils.V2) (from *keyring, to *keyring, err error)
+
+// rekeyEnvelope - re-key the secrets in the envelope from one keyring to another, both built
+// from the envelope once it is locked, so a concurrent change of key or recipients is never
+// overwritten. Every secret is re-keyed and verified in memory before the envelope is saved,
+// once, with the key and recipients of the new keyring, so a failure leaves the envelope
+// untouched. The keyrings are closed once the envelope is saved. Returns the names of the
+// re-keyed secrets.
+func rekeyEnvelope(ctx context.Context, path string, keyrings rekeyKeyrings, opts rekeyOptions) ([]string, error) {
+	var names []string
+	var from, to *keyring
+	defer func() {
+		if from != nil {
+			from.Close()
+			to.Close()
+		}
+	}()
+	rekey := func(envelope *utils.V2) error {
+		var err error
+		from, to, err = keyrings(*envelope)
+		if err != nil {
+			return err
+		}
+		secrets := envelope.Secrets
+		if opts.onlyStale {
+			primary, err := primaryVersion(ctx, from.primary())
+			if err != nil {
+				return err
+			}
+			if primary == "" {
+				return fmt.Errorf("key %s is not versioned, so no secrets are stale", from.keyURI)
+			}
+			secrets = nil
+			for _, secret := range envelope.Secrets {
+				if staleSecret(primary)(secret) {
+					secrets = append(secrets, secret)
+				}
+			}
+		}
+		rekeyed, err := mapSecrets(secrets, opts.concurrency, func(secret utils.Secret) (utils.Secret, error) {
+			return rekeySecret(ctx, from, to, envelope.ID, secret, opts.reseal)
+		})
+		if err != nil {
+			return err
+		}
+		for _, toAdd := range rekeyed {
+			log.Debug("Saving new secret: ", toAdd.Name, " With key: ", to.keyURI)
+			envelope.Secrets.Add(toAdd)
+			names = append(names, toAdd.Name)
+		}
+		envelope.KeyIdentifier = to.keyURI
+		envelope.Recipients = to.recipients()
+		return nil
+	}
+
+	if !opts.dryRun {
+		return names, utils.UpdateEnvelope(path, rekey)
+	}
+	envelope, err := utils.ReadEnvelope(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := envelope.EnsureID(); err != nil {
+		return nil, err
+	}
+	return names, rekey(&envelope)
+}
+
+// migrateEnvelope - upgrade an envelope to the current format version, recording the key
+// of versions that did not, and the time each secret was last updated.
+func migrateEnvelope(envelope *utils.V2, keyURI string) {
+	if envelope.KeyIdentifier == "" {
+		envelope.KeyIdentifier = keyURI
+	}
+	for i := range envelope.Secrets {
+		if envelope.Secrets[i].Updated == nil {
+			updated := envelope.Secrets[i].Created
+			envelope.Secrets[i].Updated = &updated
+		}
+	}
+	envelope.Version = utils.CurrentVersion
+}
+
+// secretAAD - the additional authenticated data binding a secret's ciphertext to its name
+// and the envelope it belongs to.
+func secretAAD(envelopeID string, name string) []byte {
+	return []byte("sctl:" + envelopeID + ":" + strings.ToUpper(name))
+}
+
+// encryptSecret - seal plaintext under a new data key wrapped by every key in the keyring,
+// bound to the secret name and envelope ID, returning a Secret ready to be stored in the
+// envelope.
+func encryptSecret(ctx context.Context, keys *keyring, envelopeID string, name string, plaintext []byte, encoding string) (utils.Secret, error) {
+	cypher, dataKeys, versions, err := cloud.SealAll(ctx, keys.clients, plaintext, secretAAD(envelopeID, name))
+	if err != nil {
+		return utils.Secret{}, err
+	}
+	// re-encode the binary data we got back.
+	return utils.Secret{
+		Name:       strings.ToUpper(name),
+		Cyphertext: base64.StdEncoding.EncodeToString(cypher),
+		DataKey:    base64.StdEncoding.EncodeToString(dataKeys[0]),
+		KeyVersion: versions[0],
+		AAD:        true,
+		Recipients: keys.recipientKeys(dataKeys),
+		Created:    time.Now(),
+		Encoding:   encoding,
+	}, nil
+}
+
+// decryptSecret - recover the plaintext of a secret. Secrets sealed with a data key have
+// it unwrapped by the first key in the keyring able to, while older secrets are decrypted
+// by the envelope's key directly. Secrets bound to their name are refused if they have
+// been moved to another name or envelope.
+func decryptSecret(ctx context.Context, keys *keyring, envelopeID string, secret utils.Secret) ([]byte, error) {
+	// uncan the base64
+	decoded, err := base64.StdEncoding.DecodeString(secret.Cyphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed secret decode")
+	}
+
+	if secret.DataKey == "" {
+		plaintext, err := keys.primary().Decrypt(ctx, decoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed secret decrypt")
+		}
+		return plaintext, nil
+	}
+
+	dataKeys, err := keys.wrappedKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	var aad []byte
+	if secret.AAD {
+		aad = secretAAD(envelopeID, secret.Name)
+	}
+	plaintext, err := cloud.OpenAny(ctx, keys.clients, decoded, dataKeys, aad)
+	if errors.Is(err, cloud.ErrUnauthenticated) {
+		return nil, fmt.Errorf("refusing to decrypt %s: the ciphertext does not belong to this secret name or envelope", secret.Name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed secret decrypt")
+	}
+	return plaintext, nil
+}
+
+// rekeySecret - move a secret and the values in its history from one keyring to another,
+// keeping its version, creation time and metadata.
+func rekeySecret(ctx context.Context, from *keyring, to *keyring, envelopeID string, secret utils.Secret, reseal bool) (utils.Secret, error) {
+	rekeyed, err := rekeyValue(ctx, from, to, envelopeID, secret, reseal)
+	if err != nil {
+		return utils.Secret{}, err
+	}
+	for _, previous := range secret.History {
+		entry, err := rekeyValue(ctx, from, to, envelopeID, previous, reseal)
+		if err != nil {
+			return utils.Secret{}, errors.Wrapf(err, "failed to re-key version %d of %s", previous.VersionNumber(), secret.Name)
+		}
+		rekeyed.History = append(rekeyed.History, entry)
+	}
+	return rekeyed, nil
+}
+
+// rekeyValue - move the value of a secret from one keyring to another. Values sealed with a
+// data key and bound to their name only have the data key re-wrapped, unless reseal is set.
+// Other values are decrypted and sealed under a new data key, migrating them to the current
+// format. Either way, the result is checked to decrypt with the new keyring's own key.
+func rekeyValue(ctx context.Context, from *keyring, to *keyring, envelopeID string, secret utils.Secret, reseal bool) (utils.Secret, error) {
+	if secret.DataKey == "" || !secret.AAD || reseal {
+		plaintext, err := decryptSecret(ctx, from, envelopeID, secret)
+		if err != nil {
+			return utils.Secret{}, err
+		}
+		resealed, err := encryptSecret(ctx, to, envelopeID, secret.Name, plaintext, secret.Encoding)
+		if err != nil {
+			return utils.Secret{}, err
+		}
+		resealed.Created = secret.Created
+		resealed.Version = secret.Version
+		resealed.Metadata = secret.Metadata
+		// Check the new ciphertext opens with the new key before it replaces the old
+		verified, err := decryptSecret(ctx, to.primaryRing(), envelopeID, resealed)
+		if err != nil {
+			return utils.Secret{}, errors.Wrapf(err, "failed to verify re-keyed secret %s", secret.Name)
+		}
+		if !bytes.Equal(verified, plaintext) {
+			return utils.Secret{}, fmt.Errorf("failed to verify re-keyed secret %s: it decrypts to a different value", secret.Name)
+		}
+		return resealed, nil
+	}
+
+	dataKeys, err := from.wrappedKeys(secret)
+	if err != nil {
+		return utils.Secret{}, err
+	}
+	dataKey, err := cloud.UnwrapAny(ctx, from.clients, dataKeys)
+	if err != nil {
+		return utils.Secret{}, errors.Wrap(err, "failed data key unwrap")
+	}
+	rewrapped, versions, err := cloud.WrapAll(ctx, to.clients, dataKey)
+	if err != nil {
+		return utils.Secret{}, errors.Wrap(err, "failed data key rewrap")
+	}
+	// Check the re-wrapped data key unwraps with the new key before it replaces the old
+	verified, err := to.primary().Decrypt(ctx, rewrapped[0])
+	if err != nil {
+		return utils.Secret{}, errors.Wrapf(err, "failed to verify re-keyed secret %s", secret.Name)
+	}
+	if !bytes.Equal(verified, dataKey) {
+		return utils.Secret{}, fmt.Errorf("failed to verify re-keyed secret %s: its data key unwraps to a different value", secret.Name)
+	}
+	return utils.Secret{
+		Name:       strings.ToUpper(secret.Name),
+		Cyphertext: secret.Cyphertext,
+		DataKey:    base64.StdEncoding.EncodeToString(rewrapped[0]),
+		KeyVersion: versions[0],
+		AAD:        secret.AAD,
+		Recipients: to.recipientKeys(rewrapped),
+		Created:    secret.Created,
+		Encoding:   secret.Encoding,
+		Version:    secret.Version,
+		Metadata:   secret.Metadata,
+	}, nil
+}
+
+// decodeSecret - undo the encoding applied to a secret's plaintext when it was added
+func decodeSecret(secret utils.Secret, plaintext []byte) ([]byte, error) {
+	// switch output if encoding == base64
+	if secret.Encoding != "base64" {
+		log.Debugf("skipping decode of %v due to encoding != base64", secret.Name)
+		return plaintext, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(plaintext))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed secret decode")
+	}
+	return decoded, nil
+}
+
 // stdinScan - read if we have data on STDIN and return to execution
 func stdinScan() ([]byte, error) {
 	// Determine if we have data available on STDIN
-	stat, err := os.Stdin.Stat()
+	stat, err := stdin.Stat()
 	if err != nil {
 		return nil, err
 	}
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
 		// we presume data is being piped to stdin
-		rawInput, err := io.ReadAll(os.Stdin)
+		rawInput, err := io.ReadAll(stdin)
 		if err != nil {
 			return nil, err
 		}
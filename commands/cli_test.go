@@ -0,0 +1,1159 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/cloud/gcstest"
+	"github.com/vapor-ware/sctl/cloud/kmstest"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestMain(m *testing.M) {
+	kmstest.Register()
+	cloud.RegisterStateManagers()
+	utils.EnvelopeIntegrity = EnvelopeIntegrity(0)
+	os.Exit(m.Run())
+}
+
+// testKeys returns the key URIs of count fake keys unique to the test.
+func testKeys(t *testing.T, count int) []string {
+	var uris []string
+	for i := 0; i < count; i++ {
+		uris = append(uris, fmt.Sprintf("%s://%s/%d", kmstest.Scheme, t.Name(), i))
+	}
+	return uris
+}
+
+// testKeyring builds a keyring of fake keys, with the given number of
+// recipients.
+func testKeyring(t *testing.T, recipients int) *keyring {
+	uris := testKeys(t, recipients+1)
+	keys, err := newKeyring(uris[0], uris[1:])
+	assert.NoError(t, err)
+	t.Cleanup(func() { keys.Close() })
+	return keys
+}
+
+// testSctl runs sctl with the given arguments and piped input, returning its output.
+func testSctl(t *testing.T, input string, args ...string) (string, error) {
+	piped := filepath.Join(t.TempDir(), "stdin")
+	err := os.WriteFile(piped, []byte(input), 0600)
+	assert.NoError(t, err)
+	if input == "" {
+		// Nothing piped, as with an interactive terminal
+		piped = os.DevNull
+	}
+	file, err := os.Open(piped)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	previous := stdin
+	stdin = file
+	defer func() { stdin = previous }()
+
+	var out bytes.Buffer
+	app := cli.NewApp()
+	app.Writer = &out
+	app.Commands = BuildContextualMenu()
+	err = app.Run(append([]string{"sctl"}, args...))
+	return out.String(), err
+}
+
+// Exercise the lifecycle of an envelope against the Cloud KMS stand-in.
+func TestCommandsEndToEnd(t *testing.T) {
+	kmstest.Start(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SCTL_KEY", "")
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	key := "gcpkms://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"
+	newKey := "gcpkms-rsa://projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-rsa/cryptoKeyVersions/1"
+
+	// add: piped input, and input as an argument with the key taken from the envelope
+	_, err := testSctl(t, "hunter2\n", "add", "--key", key, "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "add", "--no-decode", "--envelope", envelope, "api_token", "abc123")
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "list", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "0] API_TOKEN\n1] DB_PASSWORD\n", out)
+
+	// read: by name and by index
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "0")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123\n", out)
+
+	// run
+	out, err = testSctl(t, "", "run", "--envelope", envelope, "sh", "-c", "echo $DB_PASSWORD $API_TOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2 abc123\n", out)
+
+	// rekey onto an asymmetric key
+	_, err = testSctl(t, "", "rekey", "--envelope", envelope, "--newkey", newKey)
+	assert.NoError(t, err)
+	state, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, state.KeyIdentifier)
+	assert.Len(t, state.Secrets, 2)
+	assert.Nil(t, state.Integrity)
+
+	// An asymmetric key can not seal the envelope, so it is only used when allowed
+	_, err = testSctl(t, "", "run", "--envelope", envelope, "sh", "-c", "echo $DB_PASSWORD $API_TOKEN")
+	assert.ErrorIs(t, err, utils.ErrUnsealed)
+	out, err = testSctl(t, "", "run", "--allow-unsealed", "--envelope", envelope, "sh", "-c", "echo $DB_PASSWORD $API_TOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2 abc123\n", out)
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.Error(t, err)
+
+	// rm
+	_, err = testSctl(t, "", "rm", "--envelope", envelope, "api_token")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "read", "--allow-unsealed", "--envelope", envelope, "api_token")
+	assert.EqualError(t, err, "Secret API_TOKEN not found")
+}
+
+// Rotating the key leaves secrets stale until they are re-keyed onto the new version.
+func TestCommandsStaleKeyVersions(t *testing.T) {
+	server := kmstest.Start(t)
+	t.Setenv("SCTL_KEY", "")
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	key := "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev"
+
+	_, err := testSctl(t, "hunter2", "add", "--key", key, "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	out, err := testSctl(t, "", "status", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Key: "+key+"\nPrimary version: "+key+"/cryptoKeyVersions/1\n\n"+
+		key+"/cryptoKeyVersions/1 (primary):\n  DB_PASSWORD\n", out)
+
+	rotated := server.RotateKey(key)
+	_, err = testSctl(t, "abc123", "add", "--envelope", envelope, "api_token")
+	assert.NoError(t, err)
+	out, err = testSctl(t, "", "status", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Key: "+key+"\nPrimary version: "+rotated+"\n\n"+
+		key+"/cryptoKeyVersions/1 (stale):\n  DB_PASSWORD\n\n"+
+		rotated+" (primary):\n  API_TOKEN\n", out)
+
+	before, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+
+	_, err = testSctl(t, "", "rekey", "--only-stale", "--newkey", key+"-new", "--envelope", envelope)
+	assert.EqualError(t, err, "--only-stale can not be combined with a change of key or recipients")
+	_, err = testSctl(t, "", "rekey", "--only-stale", "--envelope", envelope)
+	assert.NoError(t, err)
+
+	after, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	rekeyed := map[string]utils.Secret{}
+	for _, secret := range after.Secrets {
+		assert.Equal(t, rotated, secret.KeyVersion)
+		rekeyed[secret.Name] = secret
+	}
+	// Only the stale secret was re-keyed
+	for _, secret := range before.Secrets {
+		if secret.Name == "API_TOKEN" {
+			assert.Equal(t, secret, rekeyed[secret.Name])
+		} else {
+			assert.NotEqual(t, secret.DataKey, rekeyed[secret.Name].DataKey)
+		}
+	}
+
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+
+	// Previous values sealed with an old version are stale too
+	_, err = testSctl(t, "hunter3", "add", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	latest := server.RotateKey(key)
+	_, err = testSctl(t, "hunter4", "add", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	out, err = testSctl(t, "", "status", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Key: "+key+"\nPrimary version: "+latest+"\n\n"+
+		rotated+" (stale):\n  API_TOKEN\n  DB_PASSWORD (version 1)\n  DB_PASSWORD (version 2)\n\n"+
+		latest+" (primary):\n  DB_PASSWORD\n", out)
+
+	_, err = testSctl(t, "", "rekey", "--only-stale", "--envelope", envelope)
+	assert.NoError(t, err)
+	after, err = utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	secret, err := after.Secrets.Find("DB_PASSWORD")
+	assert.NoError(t, err)
+	assert.Len(t, secret.History, 2)
+	for _, previous := range secret.History {
+		assert.Equal(t, latest, previous.KeyVersion)
+	}
+	out, err = testSctl(t, "", "read", "--version", "1", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+
+	// Unversioned keys have nothing stale
+	local := filepath.Join(t.TempDir(), ".scuttle.json")
+	_, err = testSctl(t, "hunter2", "add", "--key", testKeys(t, 1)[0], "--envelope", local, "db_password")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "rekey", "--only-stale", "--envelope", local)
+	assert.Error(t, err)
+}
+
+// A dry run re-keys every secret without saving the envelope.
+func TestCommandsRekeyDryRun(t *testing.T) {
+	keys := testKeys(t, 2)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	_, err := testSctl(t, "hunter2", "add", "--key", keys[0], "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	before, err := os.ReadFile(envelope)
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "rekey", "--dry-run", "--newkey", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Would re-key 1 secrets to "+keys[1]+"\n  DB_PASSWORD\n", out)
+	after, err := os.ReadFile(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	_, err = os.Stat(envelope + utils.BackupSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Secret metadata is recorded on add, edited with meta set, and survives rotation and rekey.
+func TestCommandsMetadata(t *testing.T) {
+	keys := testKeys(t, 2)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	_, err := testSctl(t, "hunter2", "add", "--key", keys[0], "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "meta", "set", "--envelope", envelope, "db_password", "description=Database password", "tags=db,prod", "rotation_period=90d")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "meta", "set", "--envelope", envelope, "db_password", "rotation_period=soon")
+	assert.Error(t, err)
+	_, err = testSctl(t, "", "meta", "set", "--envelope", envelope, "api_token", "description=missing")
+	assert.EqualError(t, err, "Secret API_TOKEN not found")
+
+	before, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.CurrentVersion, before.Version)
+	secret := before.Secrets[0]
+	assert.Equal(t, utils.CurrentUser(), secret.CreatedBy)
+	assert.Equal(t, secret.Created, *secret.Updated)
+
+	// Rotating the value keeps the metadata
+	_, err = testSctl(t, "hunter3", "add", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "rekey", "--newkey", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "meta", "get", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Len(t, lines, 6)
+	assert.True(t, strings.HasPrefix(lines[0], "created="))
+	assert.True(t, strings.HasPrefix(lines[1], "updated="))
+	assert.Equal(t, []string{
+		"created_by=" + utils.CurrentUser(),
+		"description=Database password",
+		"tags=db,prod",
+		"rotation_period=90d",
+	}, lines[2:])
+
+	after, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.True(t, after.Secrets[0].Updated.After(*secret.Updated))
+}
+
+// Version 1 and 2 envelopes are migrated to the current version in place.
+func TestCommandsMigrate(t *testing.T) {
+	// Migrating seals the envelope's integrity, which needs its key
+	kmstest.Start(t)
+	key := testKeys(t, 1)[0]
+	var testTable = []struct {
+		name     string
+		fixture  string
+		from     string
+		expected string
+	}{
+		{"Version 1", "../testdata/test_single.json", "1", key},
+		{"Version 2", "../testdata/test_secret_v2.json", "2", "/projects/scuttle/locations/us/keyrings/sctl-dev/keys/sctl-testing"},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture, err := os.ReadFile(tt.fixture)
+			assert.NoError(t, err)
+			envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+			assert.NoError(t, os.WriteFile(envelope, fixture, 0600))
+
+			out, err := testSctl(t, "", "migrate", "--key", key, "--envelope", envelope)
+			assert.NoError(t, err)
+			assert.Equal(t, "Migrated "+envelope+" from version "+tt.from+" to 4\n", out)
+
+			migrated, err := utils.ReadEnvelope(envelope)
+			assert.NoError(t, err)
+			assert.Equal(t, "4", migrated.Version)
+			assert.NotNil(t, migrated.Integrity)
+			assert.Equal(t, tt.expected, migrated.KeyIdentifier)
+			assert.Len(t, migrated.Secrets, 1)
+			assert.Equal(t, migrated.Secrets[0].Created, *migrated.Secrets[0].Updated)
+		})
+	}
+
+	_, err := testSctl(t, "", "migrate", "--envelope", filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+// Previous values of a secret can be listed, read and restored, and survive a rekey.
+func TestCommandsHistory(t *testing.T) {
+	keys := testKeys(t, 2)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	for _, value := range []string{"one", "two", "three"} {
+		_, err := testSctl(t, value, "add", "--key", keys[0], "--envelope", envelope, "db_password")
+		assert.NoError(t, err)
+	}
+	_, err := testSctl(t, "", "rekey", "--newkey", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "history", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "3\t"))
+	assert.True(t, strings.HasSuffix(lines[0], "\tcurrent"))
+	assert.True(t, strings.HasPrefix(lines[2], "1\t"))
+
+	for version, expected := range map[string]string{"1": "one\n", "2": "two\n", "3": "three\n"} {
+		out, err = testSctl(t, "", "read", "--version", version, "--envelope", envelope, "db_password")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, out)
+	}
+	_, err = testSctl(t, "", "read", "--version", "7", "--envelope", envelope, "db_password")
+	assert.EqualError(t, err, "version 7 of DB_PASSWORD not found")
+
+	out, err = testSctl(t, "", "rollback", "--to", "1", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "Restored version 1 of DB_PASSWORD as version 4\n", out)
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "one\n", out)
+
+	// Reducing the depth discards older history
+	_, err = testSctl(t, "", "history", "--depth", "1", "--envelope", envelope)
+	assert.NoError(t, err)
+	state, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.GetHistoryDepth())
+	assert.Len(t, state.Secrets[0].History, 1)
+	_, err = testSctl(t, "", "read", "--version", "2", "--envelope", envelope, "db_password")
+	assert.Error(t, err)
+}
+
+// Envelopes carry a MAC, and tampering with their secrets is refused.
+func TestCommandsIntegrity(t *testing.T) {
+	keys := testKeys(t, 2)
+	key := keys[0]
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	for _, name := range []string{"db_password", "api_token"} {
+		_, err := testSctl(t, "hunter2", "add", "--key", key, "--envelope", envelope, name)
+		assert.NoError(t, err)
+	}
+
+	out, err := testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Verified 2 secrets in "+envelope+"\n", out)
+
+	// The integrity key is kept across saves
+	sealed, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.CurrentVersion, sealed.Version)
+	_, err = testSctl(t, "abc123", "add", "--envelope", envelope, "other")
+	assert.NoError(t, err)
+	resealed, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed.Integrity.DataKey, resealed.Integrity.DataKey)
+	assert.NotEqual(t, sealed.Integrity.MAC, resealed.Integrity.MAC)
+
+	// but replaced when the envelope's keys change
+	_, err = testSctl(t, "", "rekey", "--newkey", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+	resealed, err = utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, keys[1], resealed.Integrity.KeyURI)
+	assert.NotEqual(t, sealed.Integrity.DataKey, resealed.Integrity.DataKey)
+
+	// tamper rewrites the envelope without re-sealing it
+	tamper := func(change func(*utils.V2)) {
+		state := utils.V2{Filepath: envelope}
+		assert.NoError(t, state.Load())
+		change(&state)
+		data, err := json.MarshalIndent(state, "", " ")
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(envelope, data, 0600))
+	}
+
+	// Commands refuse it once its MAC is checked, even --allow-unsealed
+	tamper(func(state *utils.V2) { state.Secrets.Remove("API_TOKEN") })
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+	_, err = testSctl(t, "", "read", "--allow-unsealed", "--envelope", envelope, "db_password")
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+	_, err = testSctl(t, "hunter2", "add", "--envelope", envelope, "another")
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+	_, err = testSctl(t, "", "list", "--envelope", envelope)
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+
+	// Once reviewed, a holder of the key reseals it under a new integrity key
+	out, err = testSctl(t, "", "verify", "--reseal", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Resealed 2 secrets in "+envelope+"\n", out)
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+	reviewed, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.NotEqual(t, resealed.Integrity.DataKey, reviewed.Integrity.DataKey)
+
+	// A secret moved to another name does not decrypt, so is not resealed
+	tamper(func(state *utils.V2) { state.Secrets[0].Name = "MOVED" })
+	_, err = testSctl(t, "", "verify", "--reseal", "--envelope", envelope)
+	assert.Error(t, err)
+	tamper(func(state *utils.V2) { state.Secrets[0].Name = "DB_PASSWORD" })
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+
+	// The MAC of a sealed envelope can not be removed, even claiming to predate MACs
+	tamper(func(state *utils.V2) { state.Integrity = nil })
+	_, err = testSctl(t, "", "list", "--envelope", envelope)
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+	tamper(func(state *utils.V2) { state.Version = "3" })
+	for _, args := range [][]string{
+		{"read", "--allow-unsealed", "--envelope", envelope, "db_password"},
+		{"run", "--allow-unsealed", "--envelope", envelope, "true"},
+		{"add", "--allow-unsealed", "--envelope", envelope, "another"},
+	} {
+		_, err = testSctl(t, "hunter2", args...)
+		assert.ErrorIs(t, err, utils.ErrIntegrity)
+	}
+}
+
+// An envelope from before MACs is only used as it is when allowed, and sealed once it is.
+func TestCommandsUnsealedIntegrity(t *testing.T) {
+	keys := testKeyring(t, 0)
+	cypher, dataKey, err := cloud.Seal(context.Background(), keys.primary(), []byte("hunter2"), nil)
+	assert.NoError(t, err)
+	legacy := utils.V2{Version: "3", KeyIdentifier: keys.keyURI}
+	legacy.Secrets.Add(utils.Secret{
+		Name:       "DB_PASSWORD",
+		Cyphertext: base64.StdEncoding.EncodeToString(cypher),
+		DataKey:    base64.StdEncoding.EncodeToString(dataKey),
+		Encoding:   "plain",
+	})
+	data, err := json.MarshalIndent(legacy, "", " ")
+	assert.NoError(t, err)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	assert.NoError(t, os.WriteFile(envelope, data, 0600))
+
+	out, err := testSctl(t, "", "list", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "0] DB_PASSWORD\n", out)
+	for _, args := range [][]string{
+		{"read", "--envelope", envelope, "db_password"},
+		{"run", "--envelope", envelope, "true"},
+		{"add", "--envelope", envelope, "another"},
+	} {
+		_, err = testSctl(t, "abc123", args...)
+		assert.ErrorIs(t, err, utils.ErrUnsealed)
+	}
+
+	out, err = testSctl(t, "", "read", "--allow-unsealed", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.Error(t, err)
+
+	_, err = testSctl(t, "abc123", "add", "--allow-unsealed", "--envelope", envelope, "another")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "another")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123\n", out)
+}
+
+// writeOnlyKMS - a key that encrypts but may not decrypt, like one a contributor is only
+// granted the encrypter role on
+type writeOnlyKMS struct {
+	cloud.KMS
+}
+
+func (writeOnlyKMS) Decrypt(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("permission denied")
+}
+
+// asWriteOnly - run fn as a contributor only able to encrypt with the fake keys, with none
+// of the integrity keys unwrapped so far
+func asWriteOnly(fn func()) {
+	previous := utils.EnvelopeIntegrity
+	utils.EnvelopeIntegrity = EnvelopeIntegrity(0)
+	cloud.Register(kmstest.Scheme, func(key string) (cloud.KMS, error) {
+		return writeOnlyKMS{kmstest.NewFake(key)}, nil
+	})
+	defer func() {
+		kmstest.Register()
+		utils.EnvelopeIntegrity = previous
+	}()
+	fn()
+}
+
+// A contributor able to encrypt but not decrypt adds secrets without resealing the
+// envelope, leaving it for a holder of the key to review.
+func TestCommandsWriteOnlyIntegrity(t *testing.T) {
+	key := testKeys(t, 1)[0]
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	_, err := testSctl(t, "hunter2", "add", "--key", key, "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	sealed, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+
+	asWriteOnly(func() {
+		_, err := testSctl(t, "abc123", "add", "--envelope", envelope, "api_token")
+		assert.NoError(t, err)
+		_, err = testSctl(t, "", "status", "--envelope", envelope)
+		assert.NoError(t, err)
+	})
+
+	// The envelope is refused until a holder of the key reviews and reseals it
+	_, err = utils.ReadEnvelope(envelope)
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+	written, err := utils.InspectEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Len(t, written.Secrets, 2)
+	assert.Equal(t, sealed.Integrity, written.Integrity)
+	_, err = testSctl(t, "", "read", "--envelope", envelope, "api_token")
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+
+	_, err = testSctl(t, "", "verify", "--reseal", "--envelope", envelope)
+	assert.NoError(t, err)
+	out, err := testSctl(t, "", "read", "--envelope", envelope, "api_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123\n", out)
+}
+
+// New secrets are only sealed for recipients vouched for by the envelope's MAC, or confirmed.
+func TestCommandsAddRecipients(t *testing.T) {
+	keys := testKeys(t, 3)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	_, err := testSctl(t, "hunter2", "add", "--key", keys[0], "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "rekey", "--add-recipient", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+	_, err = testSctl(t, "hunter2", "add", "--envelope", envelope, "api_token")
+	assert.NoError(t, err)
+
+	// A recipient slipped into the envelope is refused by a holder of its key, as the MAC no
+	// longer matches
+	state := utils.V2{Filepath: envelope}
+	assert.NoError(t, state.Load())
+	state.Recipients = append(state.Recipients, keys[2])
+	data, err := json.MarshalIndent(state, "", " ")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(envelope, data, 0600))
+	_, err = testSctl(t, "abc123", "add", "--envelope", envelope, "another")
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+
+	// and by a writer unable to check the MAC, unless they confirm it
+	asWriteOnly(func() {
+		for _, confirmed := range [][]string{nil, {keys[1]}} {
+			args := []string{"add", "--envelope", envelope}
+			for _, uri := range confirmed {
+				args = append(args, "--recipient", uri)
+			}
+			_, err = testSctl(t, "abc123", append(args, "another")...)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), keys[2])
+		}
+		unchanged, err := os.ReadFile(envelope)
+		assert.NoError(t, err)
+		assert.Equal(t, data, unchanged)
+
+		_, err = testSctl(t, "abc123", "add", "--envelope", envelope, "--recipient", keys[1], "--recipient", keys[2], "another")
+		assert.NoError(t, err)
+	})
+	written, err := utils.InspectEnvelope(envelope)
+	assert.NoError(t, err)
+	added, err := written.Secrets.Find("ANOTHER")
+	assert.NoError(t, err)
+	assert.Len(t, added.Recipients, 2)
+}
+
+// The recovery key is public, so it does not wrap the envelope's integrity key, and unseals
+// envelopes whose key is gone without verifying them.
+func TestCommandsRecoveryIntegrity(t *testing.T) {
+	key := testKeys(t, 1)[0]
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	_, err := testSctl(t, "hunter2", "add", "--key", key, "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "recovery", "init", "--shares", "3", "--threshold", "2", "--envelope", envelope)
+	assert.NoError(t, err)
+	var shares []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "share ") {
+			shares = append(shares, line)
+		}
+	}
+	assert.Len(t, shares, 3)
+	sealed, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Len(t, sealed.Recipients, 1)
+	assert.Empty(t, sealed.Integrity.Recipients)
+
+	asWriteOnly(func() {
+		out, err = testSctl(t, strings.Join(shares[1:], "\n"), "recovery", "unseal", "--envelope", envelope)
+		assert.NoError(t, err)
+		assert.Equal(t, "DB_PASSWORD=hunter2\n", out)
+	})
+
+	// While the envelope's key remains, its MAC is still checked
+	sealed.Secrets[0].Description = "changed"
+	data, err := json.MarshalIndent(sealed, "", " ")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(envelope, data, 0600))
+	_, err = testSctl(t, strings.Join(shares[1:], "\n"), "recovery", "unseal", "--envelope", envelope)
+	assert.ErrorIs(t, err, utils.ErrIntegrity)
+}
+
+// Envelopes in a remote backend are used like local ones.
+func TestCommandsRemoteEnvelope(t *testing.T) {
+	server := gcstest.Start(t)
+	keys := testKeys(t, 2)
+	envelope := "gs://sctl-state/team/.scuttle.json"
+
+	for _, name := range []string{"db_password", "api_token"} {
+		_, err := testSctl(t, "hunter2", "add", "--key", keys[0], "--envelope", envelope, name)
+		assert.NoError(t, err)
+	}
+	_, err := testSctl(t, "", "rekey", "--newkey", keys[1], "--envelope", envelope)
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "list", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "DB_PASSWORD")
+	assert.Contains(t, out, "API_TOKEN")
+	out, err = testSctl(t, "", "read", "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+	_, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+
+	object, found := server.Object("sctl-state", "team/.scuttle.json")
+	assert.True(t, found)
+	state := utils.V2{}
+	assert.NoError(t, json.Unmarshal(object, &state))
+	assert.Equal(t, keys[1], state.KeyIdentifier)
+}
+
+// diff reports how secrets changed between envelopes, including ones read from git.
+func TestCommandsDiff(t *testing.T) {
+	key := testKeys(t, 1)[0]
+	dir := t.TempDir()
+	envelope := filepath.Join(dir, ".scuttle.json")
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := testSctl(t, "value-"+name, "add", "--key", key, "--envelope", envelope, name)
+		assert.NoError(t, err)
+	}
+	original, err := os.ReadFile(envelope)
+	assert.NoError(t, err)
+	previous := filepath.Join(t.TempDir(), "previous.json")
+	assert.NoError(t, os.WriteFile(previous, original, 0600))
+
+	_, err = testSctl(t, "rotated-a", "add", "--envelope", envelope, "a")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "meta", "set", "--envelope", envelope, "B", "description=the b")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "rm", "--envelope", envelope, "c")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "value-d", "add", "--envelope", envelope, "d")
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "diff", previous, envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated\tA (version 1 -> 2)\nmetadata\tB\nremoved\tC\nadded\tD\n"+
+		"1 added, 1 removed, 1 rotated, 1 metadata\n", out)
+
+	out, err = testSctl(t, "", "diff", "--decrypt", "--reveal", previous, envelope)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "rotated\tA (version 1 -> 2) value changed\n\t- value-a\n\t+ rotated-a\n")
+	assert.Contains(t, out, "removed\tC\n\t- value-c\n")
+
+	_, err = testSctl(t, "", "diff", "--reveal", previous, envelope)
+	assert.Error(t, err)
+
+	// Compare the working copy with git
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=sctl", "-c", "user.email=sctl@example.com"}, args...)...)
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+	}
+	assert.NoError(t, os.Rename(envelope, envelope+".new"))
+	assert.NoError(t, os.WriteFile(envelope, original, 0600))
+	git("init", "-q")
+	git("add", ".scuttle.json")
+	git("commit", "-q", "-m", "envelope")
+	assert.NoError(t, os.Rename(envelope+".new", envelope))
+
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+
+	out, err = testSctl(t, "", "diff")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "1 added, 1 removed, 1 rotated, 1 metadata\n")
+	out, err = testSctl(t, "", "diff", "git:HEAD:./missing.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "added\tA\nadded\tB\nadded\tD\n3 added\n", out)
+	_, err = testSctl(t, "", "diff", "git:NOPE:./.scuttle.json")
+	assert.Error(t, err)
+}
+
+func TestCommandsMergeDriver(t *testing.T) {
+	key := testKeys(t, 1)[0]
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.json")
+	for _, name := range []string{"a", "b"} {
+		_, err := testSctl(t, "value-"+name, "add", "--key", key, "--envelope", base, name)
+		assert.NoError(t, err)
+	}
+	original, err := os.ReadFile(base)
+	assert.NoError(t, err)
+	ours, theirs := filepath.Join(dir, "ours.json"), filepath.Join(dir, "theirs.json")
+	assert.NoError(t, os.WriteFile(ours, original, 0600))
+	assert.NoError(t, os.WriteFile(theirs, original, 0600))
+
+	_, err = testSctl(t, "value-c", "add", "--envelope", ours, "c")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "rotated-a", "add", "--envelope", theirs, "a")
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "rm", "--envelope", theirs, "b")
+	assert.NoError(t, err)
+
+	_, err = testSctl(t, "", "merge-driver", base, ours, theirs)
+	assert.NoError(t, err)
+	_, err = os.Stat(ours + utils.BackupSuffix)
+	assert.True(t, os.IsNotExist(err))
+	out, err := testSctl(t, "", "list", "--envelope", ours)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "A")
+	assert.Contains(t, out, "C")
+	assert.NotContains(t, out, "B")
+	out, err = testSctl(t, "", "read", "--envelope", ours, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated-a", strings.TrimSpace(out))
+
+	// Secrets changed differently on both sides conflict, leaving ours untouched
+	_, err = testSctl(t, "other-c", "add", "--envelope", theirs, "c")
+	assert.NoError(t, err)
+	merged, err := os.ReadFile(ours)
+	assert.NoError(t, err)
+	_, err = testSctl(t, "", "merge-driver", base, ours, theirs)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "C was changed differently on both sides")
+	}
+	unchanged, err := os.ReadFile(ours)
+	assert.NoError(t, err)
+	assert.Equal(t, merged, unchanged)
+
+	_, err = testSctl(t, "", "merge-driver", base, ours)
+	assert.Error(t, err)
+
+	// Registering the driver with git
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := t.TempDir()
+	output, err := exec.Command("git", "init", "-q", repo).CombinedOutput()
+	assert.NoError(t, err, string(output))
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(repo))
+	defer os.Chdir(cwd)
+
+	assert.NoError(t, os.WriteFile(".gitattributes", []byte("*.png binary"), 0644))
+	for i := 0; i < 2; i++ {
+		out, err = testSctl(t, "", "git", "install")
+		assert.NoError(t, err)
+		assert.Equal(t, "Registered the sctl merge driver for .scuttle.json\n", out)
+	}
+	attributes, err := os.ReadFile(".gitattributes")
+	assert.NoError(t, err)
+	assert.Equal(t, "*.png binary\n.scuttle.json merge=sctl\n", string(attributes))
+	driver, err := exec.Command("git", "config", "merge.sctl.driver").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "sctl merge-driver %O %A %B\n", string(driver))
+}
+
+// Envelopes are saved canonically, and fmt restores the canonical form without resealing.
+func TestCommandsFmt(t *testing.T) {
+	key := testKeys(t, 1)[0]
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+	for _, name := range []string{"b", "a", "b"} {
+		_, err := testSctl(t, "value-"+name, "add", "--key", key, "--envelope", envelope, name)
+		assert.NoError(t, err)
+	}
+	out, err := testSctl(t, "", "fmt", "--check", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	// As a hand edit might leave it
+	contents, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	contents.Secrets[0], contents.Secrets[1] = contents.Secrets[1], contents.Secrets[0]
+	edited, err := json.Marshal(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(envelope, edited, 0600))
+
+	_, err = testSctl(t, "", "fmt", "--check", "--envelope", envelope)
+	assert.Error(t, err)
+	out, err = testSctl(t, "", "fmt", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Formatted "+envelope+"\n", out)
+	_, err = testSctl(t, "", "fmt", "--check", "--envelope", envelope)
+	assert.NoError(t, err)
+
+	out, err = testSctl(t, "", "verify", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "Verified 2 secrets in "+envelope+"\n", out)
+	out, err = testSctl(t, "", "list", "--envelope", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "0] A\n1] B\n", out)
+}
+
+// The quick commands round trip without an envelope.
+func TestCommandsEncryptDecrypt(t *testing.T) {
+	key := testKeys(t, 1)[0]
+
+	out, err := testSctl(t, "hunter2", "encrypt", "--key", key)
+	assert.NoError(t, err)
+	lines := strings.Split(out, "\n")
+	assert.Equal(t, "```", lines[0])
+	fields := strings.Fields(lines[1])
+	assert.Equal(t, []string{"sctl", "decrypt", "--key=" + key}, fields[:3])
+
+	out, err = testSctl(t, "", "decrypt", "--key", key, fields[3])
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2\n", out)
+}
+
+// Generated local keys are referenced by their absolute path, wherever sctl runs from.
+func TestCommandsKeygen(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "dev.key")
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	relative, err := filepath.Rel(cwd, keyfile)
+	assert.NoError(t, err)
+
+	out, err := testSctl(t, "", "keygen", relative)
+	assert.NoError(t, err)
+	assert.Equal(t, "Generated local key. Use it with --key="+cloud.LocalScheme+keyfile+"\n", out)
+	_, err = os.Stat(keyfile)
+	assert.NoError(t, err)
+}
+
+// Commands fail cleanly when the KMS refuses to decrypt.
+func TestCommandsWrongKey(t *testing.T) {
+	keys := testKeys(t, 2)
+	envelope := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	_, err := testSctl(t, "hunter2", "add", "--key", keys[0], "--envelope", envelope, "db_password")
+	assert.NoError(t, err)
+
+	// Corrupt the envelope's key, as though it had been swapped
+	state, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	state.KeyIdentifier = keys[1]
+	assert.NoError(t, state.Save())
+
+	_, err = testSctl(t, "", "read", "--envelope", envelope, "db_password")
+	assert.Error(t, err)
+	_, err = testSctl(t, "", "run", "--envelope", envelope, "true")
+	assert.Error(t, err)
+	_, err = testSctl(t, "", "rekey", "--envelope", envelope)
+	assert.Error(t, err)
+
+	// Nothing was written by the failed rekey
+	after, err := utils.ReadEnvelope(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Secrets[0].DataKey, after.Secrets[0].DataKey)
+}
+
+func TestEncryptDecryptSecret(t *testing.T) {
+	client := testKeyring(t, 0)
+	ctx := context.Background()
+
+	secret, err := encryptSecret(ctx, client, "envelope-a", "db_password", []byte("hunter2"), "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "DB_PASSWORD", secret.Name)
+	assert.True(t, secret.AAD)
+
+	plaintext, err := decryptSecret(ctx, client, "envelope-a", secret)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), plaintext)
+}
+
+// A ciphertext copied onto another secret, or into another envelope, must not decrypt.
+func TestDecryptSecretRefusesMovedCiphertext(t *testing.T) {
+	client := testKeyring(t, 0)
+	ctx := context.Background()
+
+	secret, err := encryptSecret(ctx, client, "envelope-a", "DB_PASSWORD", []byte("hunter2"), "plain")
+	assert.NoError(t, err)
+
+	renamed := secret
+	renamed.Name = "ADMIN_TOKEN"
+	_, err = decryptSecret(ctx, client, "envelope-a", renamed)
+	assert.EqualError(t, err, "refusing to decrypt ADMIN_TOKEN: the ciphertext does not belong to this secret name or envelope")
+
+	_, err = decryptSecret(ctx, client, "envelope-b", secret)
+	assert.Error(t, err)
+
+	// Dropping the flag does not strip the binding
+	unflagged := renamed
+	unflagged.AAD = false
+	_, err = decryptSecret(ctx, client, "envelope-a", unflagged)
+	assert.Error(t, err)
+}
+
+// Secrets sealed before names were bound keep working, and are bound once rekeyed.
+func TestRekeySecretBindsLegacySecret(t *testing.T) {
+	client := testKeyring(t, 0)
+	ctx := context.Background()
+
+	cypher, dataKey, err := cloud.Seal(ctx, client.primary(), []byte("hunter2"), nil)
+	assert.NoError(t, err)
+	legacy := utils.Secret{
+		Name:       "DB_PASSWORD",
+		Cyphertext: base64.StdEncoding.EncodeToString(cypher),
+		DataKey:    base64.StdEncoding.EncodeToString(dataKey),
+		Encoding:   "plain",
+	}
+
+	plaintext, err := decryptSecret(ctx, client, "envelope-a", legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), plaintext)
+
+	rekeyed, err := rekeySecret(ctx, client, client, "envelope-a", legacy, false)
+	assert.NoError(t, err)
+	assert.True(t, rekeyed.AAD)
+	assert.NotEqual(t, legacy.Cyphertext, rekeyed.Cyphertext)
+
+	plaintext, err = decryptSecret(ctx, client, "envelope-a", rekeyed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), plaintext)
+
+	// Bound secrets only have their data key re-wrapped
+	rewrapped, err := rekeySecret(ctx, client, client, "envelope-a", rekeyed, false)
+	assert.NoError(t, err)
+	assert.Equal(t, rekeyed.Cyphertext, rewrapped.Cyphertext)
+	assert.True(t, rewrapped.AAD)
+}
+
+// Any recipient can decrypt a secret on its own.
+func TestDecryptSecretRecipients(t *testing.T) {
+	keys := testKeyring(t, 2)
+	ctx := context.Background()
+
+	secret, err := encryptSecret(ctx, keys, "envelope-a", "DB_PASSWORD", []byte("hunter2"), "plain")
+	assert.NoError(t, err)
+	assert.Len(t, secret.Recipients, 2)
+	assert.Equal(t, keys.uris[1], secret.Recipients[0].KeyURI)
+	assert.Equal(t, keys.uris[2], secret.Recipients[1].KeyURI)
+
+	for i, uri := range keys.uris {
+		t.Run(fmt.Sprintf("Key %d", i), func(t *testing.T) {
+			// The remaining keys are lost
+			lost := testKeys(t, 3)
+			uris := append([]string{}, lost...)
+			uris[i] = uri
+			recovery, err := newKeyring(uris[0], uris[1:])
+			assert.NoError(t, err)
+			defer recovery.Close()
+
+			plaintext, err := decryptSecret(ctx, recovery, "envelope-a", secret)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("hunter2"), plaintext)
+		})
+	}
+
+	// Renaming is still refused when the envelope's key is unavailable
+	renamed := secret
+	renamed.Name = "ADMIN_TOKEN"
+	_, err = decryptSecret(ctx, keys, "envelope-a", renamed)
+	assert.Error(t, err)
+}
+
+// Re-keying can add and drop recipients, and re-key with a recipient when the envelope's
+// key is lost.
+func TestRekeySecretRecipients(t *testing.T) {
+	uris := testKeys(t, 3)
+	ctx := context.Background()
+
+	keys, err := newKeyring(uris[0], nil)
+	assert.NoError(t, err)
+	secret, err := encryptSecret(ctx, keys, "envelope-a", "DB_PASSWORD", []byte("hunter2"), "plain")
+	assert.NoError(t, err)
+	assert.Empty(t, secret.Recipients)
+
+	// Add a recipient
+	withRecipient, err := newKeyring(uris[0], []string{uris[1]})
+	assert.NoError(t, err)
+	added, err := rekeySecret(ctx, keys, withRecipient, "envelope-a", secret, false)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Cyphertext, added.Cyphertext)
+	assert.Len(t, added.Recipients, 1)
+
+	// Lose the envelope's key, and recover onto a new key with the recipient
+	lost := testKeys(t, 1)[0]
+	recovery, err := newKeyring(lost, []string{uris[1]})
+	assert.NoError(t, err)
+	replacement, err := newKeyring(uris[2], []string{uris[1]})
+	assert.NoError(t, err)
+	recovered, err := rekeySecret(ctx, recovery, replacement, "envelope-a", added, false)
+	assert.NoError(t, err)
+
+	// Drop the recipient, sealing under a new data key
+	dropped, err := rekeySecret(ctx, replacement, testKeyringOf(t, uris[2]), "envelope-a", recovered, true)
+	assert.NoError(t, err)
+	assert.Empty(t, dropped.Recipients)
+	assert.NotEqual(t, recovered.Cyphertext, dropped.Cyphertext)
+
+	plaintext, err := decryptSecret(ctx, testKeyringOf(t, uris[2]), "envelope-a", dropped)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), plaintext)
+
+	_, err = decryptSecret(ctx, testKeyringOf(t, lost, uris[1]), "envelope-a", dropped)
+	assert.Error(t, err)
+}
+
+// corruptKMS decrypts to the wrong value, as a misbehaving KMS might.
+type corruptKMS struct {
+	cloud.KMS
+}
+
+func (c corruptKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.KMS.Decrypt(ctx, ciphertext)
+	return append(plaintext, 0), err
+}
+
+// Re-keyed secrets that do not verify leave the envelope as it was.
+func TestRekeyEnvelopeVerifies(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+	keys := testKeyring(t, 0)
+
+	err := utils.UpdateEnvelope(path, func(envelope *utils.V2) error {
+		for _, name := range []string{"A", "B"} {
+			secret, err := encryptSecret(ctx, keys, envelope.ID, name, []byte("hunter2"), "plain")
+			if err != nil {
+				return err
+			}
+			envelope.Secrets.Add(secret)
+		}
+		envelope.KeyIdentifier = keys.keyURI
+		return nil
+	})
+	assert.NoError(t, err)
+	before, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	newKeys := testKeyring(t, 0)
+	corrupt := &keyring{keyURI: newKeys.keyURI, uris: newKeys.uris, clients: []cloud.KMS{corruptKMS{newKeys.primary()}}}
+
+	for _, reseal := range []bool{false, true} {
+		_, err = rekeyEnvelope(ctx, path, fixedKeyrings(keys, corrupt), rekeyOptions{concurrency: 2, reseal: reseal})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to verify re-keyed secret")
+		after, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, before, after)
+	}
+
+	// The keyrings are built from the envelope as read under its lock, and failing to build
+	// them leaves it as it was
+	_, err = rekeyEnvelope(ctx, path, func(envelope utils.V2) (*keyring, *keyring, error) {
+		assert.Equal(t, keys.keyURI, envelope.KeyIdentifier)
+		assert.Len(t, envelope.Secrets, 2)
+		return nil, nil, errors.New("no keyring")
+	}, rekeyOptions{concurrency: 2})
+	assert.EqualError(t, err, "no keyring")
+	after, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// The same re-key with a well behaved key succeeds, saving once
+	rekeyed, err := rekeyEnvelope(ctx, path, fixedKeyrings(keys, newKeys), rekeyOptions{concurrency: 2})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"A", "B"}, rekeyed)
+	envelope, err := utils.ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.Equal(t, newKeys.keyURI, envelope.KeyIdentifier)
+	backup, err := os.ReadFile(path + utils.BackupSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, before, backup)
+}
+
+// fixedKeyrings re-keys an envelope between keyrings built up front, whatever it holds.
+func fixedKeyrings(from *keyring, to *keyring) rekeyKeyrings {
+	return func(utils.V2) (*keyring, *keyring, error) {
+		return from, to, nil
+	}
+}
+
+func testKeyringOf(t *testing.T, keyURI string, recipients ...string) *keyring {
+	keys, err := newKeyring(keyURI, recipients)
+	assert.NoError(t, err)
+	t.Cleanup(func() { keys.Close() })
+	return keys
+}
+
+func TestUpdateRecipients(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		current  []string
+		add      []string
+		remove   []string
+		expected []string
+	}{
+		{"Add", nil, []string{"vault://dr"}, nil, []string{"vault://dr"}},
+		{"Add Existing", []string{"vault://dr"}, []string{"vault://dr"}, nil, []string{"vault://dr"}},
+		{"Add Envelope Key", nil, []string{"local://primary"}, nil, nil},
+		{"Remove", []string{"vault://dr", "local://bg"}, nil, []string{"vault://dr"}, []string{"local://bg"}},
+		{"Preserves Order", []string{"vault://dr"}, []string{"local://bg"}, nil, []string{"vault://dr", "local://bg"}},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, updateRecipients("local://primary", tt.current, tt.add, tt.remove))
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// gitSourcePrefix marks an envelope to compare that is read from git, eg: git:HEAD:.scuttle.json
+const gitSourcePrefix = "git:"
+
+// the ways a secret can differ between two envelopes, in the order they are summarized
+const (
+	changeAdded     = "added"
+	changeRemoved   = "removed"
+	changeRotated   = "rotated"
+	changeRekeyed   = "re-keyed"
+	changeMetadata  = "metadata"
+	changeUnchanged = "unchanged"
+)
+
+var changeKinds = []string{changeAdded, changeRemoved, changeRotated, changeRekeyed, changeMetadata, changeUnchanged}
+
+// secretChange - how a named secret differs between an old and a new envelope. old or new
+// is the zero Secret when the secret is missing from that envelope.
+type secretChange struct {
+	name string
+	kind string
+	old  utils.Secret
+	new  utils.Secret
+}
+
+// diffSecrets - compare every secret named in either envelope, sorted by name. A secret is
+// rotated when its value was replaced, and re-keyed when only its sealing changed.
+func diffSecrets(previous utils.Secrets, current utils.Secrets) []secretChange {
+	seen := map[string]bool{}
+	var names []string
+	for _, secret := range append(append(utils.Secrets{}, previous...), current...) {
+		if !seen[secret.Name] {
+			seen[secret.Name] = true
+			names = append(names, secret.Name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []secretChange
+	for _, name := range names {
+		change := secretChange{name: name}
+		before, oldErr := previous.Find(name)
+		after, newErr := current.Find(name)
+		change.old, change.new = before, after
+		switch {
+		case oldErr != nil:
+			change.kind = changeAdded
+		case newErr != nil:
+			change.kind = changeRemoved
+		case before.VersionNumber() != after.VersionNumber() || !before.Created.Equal(after.Created):
+			change.kind = changeRotated
+		case before.Cyphertext != after.Cyphertext || before.DataKey != after.DataKey ||
+			before.KeyVersion != after.KeyVersion || !reflect.DeepEqual(before.Recipients, after.Recipients):
+			change.kind = changeRekeyed
+		case !reflect.DeepEqual(before.Metadata, after.Metadata):
+			change.kind = changeMetadata
+		default:
+			change.kind = changeUnchanged
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// loadDiffSource - load an envelope to compare, from a path or URL, or from git as
+// git:REV:PATH with PATH as git show takes it (./ for relative to the current directory).
+// An envelope that does not exist yet is empty. The envelope's MAC is not verified, so
+// changes that fail verification can be reviewed.
+func loadDiffSource(source string) (utils.V2, error) {
+	if !strings.HasPrefix(source, gitSourcePrefix) {
+		envelope, err := utils.InspectEnvelope(source)
+		if os.IsNotExist(err) {
+			return utils.V2{Filepath: source}, nil
+		}
+		return envelope, err
+	}
+	rev, path, found := strings.Cut(strings.TrimPrefix(source, gitSourcePrefix), ":")
+	if !found || rev == "" || path == "" {
+		return utils.V2{}, fmt.Errorf("invalid git source %q - expected git:REV:PATH", source)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "show", rev+":"+path)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "does not exist") || strings.Contains(message, "exists on disk, but not in") {
+			// The envelope was added after rev
+			return utils.V2{}, nil
+		}
+		if message == "" {
+			message = err.Error()
+		}
+		return utils.V2{}, fmt.Errorf("unable to read %s from git: %s", source, message)
+	}
+	return utils.ParseEnvelope(data, source)
+}
+
+// diffValues - the decrypted values of the secrets that changed, by name, as a pair of
+// before and after values. A missing side is nil.
+type diffValues map[string][2][]byte
+
+// decryptChanges - decrypt both sides of every change other than metadata, with each
+// envelope's own keys
+func decryptChanges(ctx context.Context, previous utils.V2, current utils.V2, changes []secretChange) (diffValues, error) {
+	values := diffValues{}
+	decrypt := func(envelope utils.V2, secrets []utils.Secret) ([][]byte, error) {
+		if len(secrets) == 0 {
+			return nil, nil
+		}
+		keys, err := newKeyring(envelope.KeyIdentifier, envelope.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		defer keys.Close()
+		var plaintexts [][]byte
+		for _, secret := range secrets {
+			plaintext, err := decryptSecret(ctx, keys, envelope.ID, secret)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to decrypt %s", secret.Name)
+			}
+			decoded, err := decodeSecret(secret, plaintext)
+			if err != nil {
+				return nil, err
+			}
+			plaintexts = append(plaintexts, decoded)
+		}
+		return plaintexts, nil
+	}
+
+	var before, after []utils.Secret
+	var beforeNames, afterNames []string
+	for _, change := range changes {
+		if change.kind == changeUnchanged || change.kind == changeMetadata {
+			continue
+		}
+		if change.kind != changeAdded {
+			before = append(before, change.old)
+			beforeNames = append(beforeNames, change.name)
+		}
+		if change.kind != changeRemoved {
+			after = append(after, change.new)
+			afterNames = append(afterNames, change.name)
+		}
+	}
+	oldValues, err := decrypt(previous, before)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := decrypt(current, after)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range beforeNames {
+		pair := values[name]
+		pair[0] = oldValues[i]
+		values[name] = pair
+	}
+	for i, name := range afterNames {
+		pair := values[name]
+		pair[1] = newValues[i]
+		values[name] = pair
+	}
+	return values, nil
+}
+
+// maskValue - describe a secret value without revealing it
+func maskValue(value []byte) string {
+	return fmt.Sprintf("******** (%d bytes)", len(value))
+}
+
+// printDiff - report each secret's change, followed by a summary. With values, changed
+// values are shown masked, or in full when reveal is set.
+func printDiff(w io.Writer, changes []secretChange, values diffValues, reveal bool) {
+	counts := map[string]int{}
+	for _, change := range changes {
+		counts[change.kind]++
+		detail := ""
+		if change.kind == changeRotated {
+			detail = fmt.Sprintf(" (version %d -> %d)", change.old.VersionNumber(), change.new.VersionNumber())
+		}
+		pair, decrypted := values[change.name]
+		if decrypted && pair[0] != nil && pair[1] != nil {
+			if bytes.Equal(pair[0], pair[1]) {
+				detail += " value unchanged"
+			} else {
+				detail += " value changed"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s%s\n", change.kind, change.name, detail)
+
+		if !decrypted || (pair[0] != nil && pair[1] != nil && bytes.Equal(pair[0], pair[1])) {
+			continue
+		}
+		for i, prefix := range []string{"-", "+"} {
+			if pair[i] == nil {
+				continue
+			}
+			if !reveal {
+				fmt.Fprintf(w, "\t%s %s\n", prefix, maskValue(pair[i]))
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(string(pair[i]), "\n"), "\n") {
+				fmt.Fprintf(w, "\t%s %s\n", prefix, line)
+			}
+		}
+	}
+
+	var summary []string
+	for _, kind := range changeKinds {
+		if counts[kind] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	if len(summary) == 0 {
+		summary = []string{"no secrets"}
+	}
+	fmt.Fprintln(w, strings.Join(summary, ", "))
+}
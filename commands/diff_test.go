@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestDiffSecrets(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	secret := utils.Secret{Name: "A", Cyphertext: "a", DataKey: "ka", Created: created}
+
+	rotated := secret
+	rotated.Cyphertext, rotated.Created, rotated.Version = "a2", created.AddDate(0, 0, 1), 2
+	rekeyed := secret
+	rekeyed.Cyphertext, rekeyed.DataKey = "a'", "ka'"
+	described := secret
+	described.Description = "the A"
+
+	var testTable = []struct {
+		name     string
+		previous utils.Secrets
+		current  utils.Secrets
+		expected string
+	}{
+		{"Added", nil, utils.Secrets{secret}, changeAdded},
+		{"Removed", utils.Secrets{secret}, nil, changeRemoved},
+		{"Rotated", utils.Secrets{secret}, utils.Secrets{rotated}, changeRotated},
+		{"Re-keyed", utils.Secrets{secret}, utils.Secrets{rekeyed}, changeRekeyed},
+		{"Metadata", utils.Secrets{secret}, utils.Secrets{described}, changeMetadata},
+		{"Unchanged", utils.Secrets{secret}, utils.Secrets{secret}, changeUnchanged},
+	}
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := diffSecrets(tt.previous, tt.current)
+			assert.Len(t, changes, 1)
+			assert.Equal(t, "A", changes[0].name)
+			assert.Equal(t, tt.expected, changes[0].kind)
+		})
+	}
+
+	// Secrets are compared by name, in order
+	changes := diffSecrets(utils.Secrets{{Name: "C"}, {Name: "A"}}, utils.Secrets{{Name: "B"}, {Name: "A"}})
+	var names []string
+	for _, change := range changes {
+		names = append(names, change.name+" "+change.kind)
+	}
+	assert.Equal(t, []string{"A unchanged", "B added", "C removed"}, names)
+}
+
+func TestPrintDiff(t *testing.T) {
+	changes := []secretChange{
+		{name: "A", kind: changeRotated, old: utils.Secret{Version: 1}, new: utils.Secret{Version: 2}},
+		{name: "B", kind: changeAdded},
+		{name: "C", kind: changeRekeyed},
+		{name: "D", kind: changeUnchanged},
+	}
+	values := diffValues{
+		"A": {[]byte("old"), []byte("new\nlines")},
+		"B": {nil, []byte("added")},
+		"C": {[]byte("same"), []byte("same")},
+	}
+
+	var out bytes.Buffer
+	printDiff(&out, changes, nil, false)
+	assert.Equal(t, "rotated\tA (version 1 -> 2)\nadded\tB\nre-keyed\tC\nunchanged\tD\n"+
+		"1 added, 1 rotated, 1 re-keyed, 1 unchanged\n", out.String())
+
+	out.Reset()
+	printDiff(&out, changes, values, false)
+	assert.Equal(t, "rotated\tA (version 1 -> 2) value changed\n"+
+		"\t- ******** (3 bytes)\n\t+ ******** (9 bytes)\n"+
+		"added\tB\n\t+ ******** (5 bytes)\n"+
+		"re-keyed\tC value unchanged\nunchanged\tD\n"+
+		"1 added, 1 rotated, 1 re-keyed, 1 unchanged\n", out.String())
+
+	out.Reset()
+	printDiff(&out, changes[:1], values, true)
+	assert.Equal(t, "rotated\tA (version 1 -> 2) value changed\n\t- old\n\t+ new\n\t+ lines\n1 rotated\n", out.String())
+
+	out.Reset()
+	printDiff(&out, nil, nil, false)
+	assert.Equal(t, "no secrets\n", out.String())
+}
@@ -0,0 +1,21 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// printHistory - list the versions of a secret, newest first, with when each was set
+func printHistory(w io.Writer, secret utils.Secret) {
+	set := secret.Created
+	if secret.Updated != nil {
+		set = *secret.Updated
+	}
+	fmt.Fprintf(w, "%d\t%s\tcurrent\n", secret.VersionNumber(), set.Format(time.RFC3339))
+	for _, previous := range secret.History {
+		fmt.Fprintf(w, "%d\t%s\n", previous.VersionNumber(), previous.Created.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// integrityKeySize - the size in bytes of the HMAC key sealing an envelope
+const integrityKeySize = 32
+
+// allowUnsealedFlag - shared flag declaration for commands that use an envelope's secrets,
+// to use an envelope without an integrity MAC as it is
+var allowUnsealedFlag = cli.BoolFlag{
+	Name:   "allow-unsealed",
+	EnvVar: "SCTL_ALLOW_UNSEALED",
+	Usage:  "Use an envelope without an integrity MAC, or under a key that can not seal one, as it is",
+}
+
+// verifyEnvelope - verify the envelope's MAC before its secrets are decrypted, trusting an
+// envelope without one if --allow-unsealed is set
+func verifyEnvelope(c *cli.Context, envelope *utils.V2) error {
+	if c.Bool("allow-unsealed") {
+		envelope.AllowUnsealed()
+	}
+	return envelope.VerifyIntegrity()
+}
+
+// kmsIntegrity - seals envelopes with a MAC under a random integrity key, which is wrapped
+// by the envelope's key and each of its recipients, like a secret's data key. The key is
+// kept across saves, so a writer unable to unwrap it can not forge a MAC without replacing
+// the key, which shows when the envelope is reviewed. Keys anyone may encrypt with, such as
+// asymmetric and recovery keys, never wrap the integrity key, as a MAC under a key anyone
+// could wrap would prove nothing.
+type kmsIntegrity struct {
+	timeout time.Duration
+
+	mu sync.Mutex
+	// keys caches integrity keys already unwrapped, by their wrapped form
+	keys map[string][]byte
+}
+
+// EnvelopeIntegrity - the provider sctl seals and verifies envelope MACs with, for use as
+// utils.EnvelopeIntegrity. timeout bounds the KMS calls made for each envelope, and zero
+// waits indefinitely.
+func EnvelopeIntegrity(timeout time.Duration) utils.IntegrityProvider {
+	return &kmsIntegrity{timeout: timeout, keys: map[string][]byte{}}
+}
+
+// Seal - MAC the envelope under its integrity key. A new key is made for an envelope without
+// one, or whose key or recipients changed, as a removed recipient may still hold the old one.
+func (k *kmsIntegrity) Seal(envelope *utils.V2) error {
+	var key []byte
+	if envelope.Integrity != nil && sameIntegrityKeys(*envelope.Integrity, envelope.KeyIdentifier, k.integrityRecipients(*envelope)) {
+		var err error
+		key, err = k.unwrap(*envelope)
+		if err != nil {
+			return err
+		}
+	} else {
+		integrity, newKey, err := k.newKey(*envelope)
+		if err != nil {
+			return err
+		}
+		envelope.Integrity, key = &integrity, newKey
+	}
+
+	mac, err := envelope.ComputeMAC(key)
+	if err != nil {
+		return err
+	}
+	envelope.Integrity.MAC = mac
+	k.remember(envelope.Integrity.DataKey, key)
+	return nil
+}
+
+// Sealable - whether the key URI may wrap an integrity key, see kmsIntegrity. Keys sctl can
+// not reach are presumed sealable, leaving the KMS to refuse them when the envelope is saved.
+func (k *kmsIntegrity) Sealable(keyURI string) bool {
+	client, err := cloud.NewKMS(keyURI)
+	if err != nil {
+		return true
+	}
+	defer client.Close()
+	public, ok := client.(cloud.PublicKeyEncrypter)
+	return !ok || !public.EncryptsWithPublicKey()
+}
+
+// integrityRecipients - the envelope's recipient keys that may wrap its integrity key
+func (k *kmsIntegrity) integrityRecipients(envelope utils.V2) []string {
+	var recipients []string
+	for _, uri := range envelope.Recipients {
+		if k.Sealable(uri) {
+			recipients = append(recipients, uri)
+		}
+	}
+	return recipients
+}
+
+// newKey - a random integrity key, wrapped for the envelope's current keys
+func (k *kmsIntegrity) newKey(envelope utils.V2) (utils.Integrity, []byte, error) {
+	keys, err := newKeyring(envelope.KeyIdentifier, k.integrityRecipients(envelope))
+	if err != nil {
+		return utils.Integrity{}, nil, err
+	}
+	defer keys.Close()
+
+	key := make([]byte, integrityKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return utils.Integrity{}, nil, errors.Wrap(err, "unable to generate integrity key")
+	}
+	ctx, cancel := k.context()
+	defer cancel()
+	wrapped, _, err := cloud.WrapAll(ctx, keys.clients, key)
+	if err != nil {
+		return utils.Integrity{}, nil, errors.Wrap(err, "unable to wrap integrity key")
+	}
+	return utils.Integrity{
+		KeyURI:     envelope.KeyIdentifier,
+		DataKey:    base64.StdEncoding.EncodeToString(wrapped[0]),
+		Recipients: keys.recipientKeys(wrapped),
+	}, key, nil
+}
+
+// sameIntegrityKeys - whether the integrity key is wrapped for exactly the key URI and
+// recipients
+func sameIntegrityKeys(integrity utils.Integrity, keyURI string, recipients []string) bool {
+	if integrity.KeyURI != keyURI || len(integrity.Recipients) != len(recipients) {
+		return false
+	}
+	for i, recipient := range integrity.Recipients {
+		if recipient.KeyURI != recipients[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify - check the envelope's MAC, unwrapping its integrity key with any of the keys it
+// was wrapped by
+func (k *kmsIntegrity) Verify(envelope utils.V2) error {
+	key, err := k.unwrap(envelope)
+	if err != nil {
+		return err
+	}
+	return envelope.VerifyMAC(key)
+}
+
+// unwrap - the envelope's integrity key, from the cache or the KMS
+func (k *kmsIntegrity) unwrap(envelope utils.V2) ([]byte, error) {
+	k.mu.Lock()
+	key, ok := k.keys[envelope.Integrity.DataKey]
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	keys, err := newKeyring(envelope.KeyIdentifier, k.integrityRecipients(envelope))
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Close()
+	wrapped, err := keys.wrappedKeys(utils.Secret{
+		DataKey:    envelope.Integrity.DataKey,
+		Recipients: envelope.Integrity.Recipients,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := k.context()
+	defer cancel()
+	key, err = cloud.UnwrapAny(ctx, keys.clients, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to unwrap envelope integrity key")
+	}
+	k.remember(envelope.Integrity.DataKey, key)
+	return key, nil
+}
+
+// remember - cache an integrity key by its wrapped form
+func (k *kmsIntegrity) remember(wrapped string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[wrapped] = key
+}
+
+// context - a context bounded by the provider's timeout
+func (k *kmsIntegrity) context() (context.Context, context.CancelFunc) {
+	if k.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), k.timeout)
+}
+
+// reviewSecrets - decrypt every value of every secret in the envelope, current and kept in
+// its history, before its contents are resealed. This proves the caller holds one of the
+// envelope's keys, and that no ciphertext was moved from another name or envelope.
+func reviewSecrets(ctx context.Context, envelope utils.V2, concurrency int) error {
+	if envelope.KeyIdentifier == "" {
+		return fmt.Errorf("envelope %s has no key to seal it with", envelope.Filepath)
+	}
+	keys, err := newKeyring(envelope.KeyIdentifier, envelope.Recipients)
+	if err != nil {
+		return err
+	}
+	defer keys.Close()
+	_, err = mapSecrets(envelope.Secrets, concurrency, func(secret utils.Secret) (bool, error) {
+		for _, value := range append([]utils.Secret{secret}, secret.History...) {
+			if _, err := decryptSecret(ctx, keys, envelope.ID, value); err != nil {
+				return false, errors.Wrapf(err, "unable to decrypt version %d of %s", value.VersionNumber(), secret.Name)
+			}
+		}
+		return true, nil
+	})
+	return err
+}
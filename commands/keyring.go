@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// keyring - the KMS clients for an envelope's key, followed by its recipient keys. Data keys
+// are wrapped by every key in the ring, and unwrapped by the first key that succeeds.
+type keyring struct {
+	// keyURI is the envelope's key, whose wrapped data key is stored in a secret's dek
+	keyURI  string
+	uris    []string
+	clients []cloud.KMS
+}
+
+// newKeyring - build a keyring for the envelope's key URI and any recipient key URIs.
+func newKeyring(keyURI string, recipients []string) (*keyring, error) {
+	keys := &keyring{keyURI: keyURI}
+	for _, uri := range append([]string{keyURI}, recipients...) {
+		client, err := cloud.NewKMS(uri)
+		if err != nil {
+			keys.Close()
+			return nil, err
+		}
+		keys.uris = append(keys.uris, uri)
+		keys.clients = append(keys.clients, client)
+	}
+	return keys, nil
+}
+
+// newRecoveryKeyring - build a keyring holding only an unsealed recovery key, for an
+// envelope sealed with keyURI.
+func newRecoveryKeyring(keyURI string, recoveryURI string, client cloud.KMS) *keyring {
+	return &keyring{
+		keyURI:  keyURI,
+		uris:    []string{recoveryURI},
+		clients: []cloud.KMS{client},
+	}
+}
+
+// primary - the client for the first key in the ring, usually the envelope's own key
+func (k *keyring) primary() cloud.KMS {
+	return k.clients[0]
+}
+
+// primaryRing - a keyring of just the primary key, sharing its client
+func (k *keyring) primaryRing() *keyring {
+	return &keyring{
+		keyURI:  k.keyURI,
+		uris:    k.uris[:1],
+		clients: k.clients[:1],
+	}
+}
+
+// Close - release every client in the ring
+func (k *keyring) Close() error {
+	for _, client := range k.clients {
+		if err := client.Close(); err != nil {
+			log.Debugf("failed to close KMS client: %v", err)
+		}
+	}
+	return nil
+}
+
+// wrappedKeys - decode a secret's wrapped data keys in keyring order. Keys the secret was
+// not sealed for are left empty.
+func (k *keyring) wrappedKeys(secret utils.Secret) ([][]byte, error) {
+	wrapped := make([][]byte, len(k.uris))
+	for i, uri := range k.uris {
+		encoded := secret.DataKey
+		if uri != k.keyURI {
+			encoded = secret.WrappedKey(uri)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed data key decode")
+		}
+		wrapped[i] = decoded
+	}
+	return wrapped, nil
+}
+
+// recipientKeys - encode the data keys wrapped by the recipient keys, in the form stored on
+// a secret. wrapped is in keyring order, as returned by cloud.SealAll.
+func (k *keyring) recipientKeys(wrapped [][]byte) []utils.WrappedKey {
+	var recipients []utils.WrappedKey
+	for i, uri := range k.uris[1:] {
+		recipients = append(recipients, utils.WrappedKey{
+			KeyURI:  uri,
+			DataKey: base64.StdEncoding.EncodeToString(wrapped[i+1]),
+		})
+	}
+	return recipients
+}
+
+// recipients - the recipient key URIs of the ring, as stored on the envelope
+func (k *keyring) recipients() []string {
+	return append([]string(nil), k.uris[1:]...)
+}
+
+// updateRecipients - apply recipient keys being added and removed to the current set,
+// preserving order and dropping duplicates and the envelope's own key.
+func updateRecipients(keyURI string, current []string, add []string, remove []string) []string {
+	drop := map[string]bool{keyURI: true}
+	for _, uri := range remove {
+		drop[uri] = true
+	}
+	var recipients []string
+	for _, uri := range append(append([]string{}, current...), add...) {
+		if drop[uri] {
+			continue
+		}
+		drop[uri] = true
+		recipients = append(recipients, uri)
+	}
+	return recipients
+}
+
+// confirmRecipients - check the recipients a new data key is about to be wrapped for. They
+// are vouched for by the envelope's integrity MAC once it verifies, otherwise each of them
+// must be in confirmed, so recipients added to the file by hand are never sealed for.
+func confirmRecipients(envelope utils.V2, confirmed []string) error {
+	if envelope.Integrity != nil && envelope.Verified() {
+		return nil
+	}
+	known := map[string]bool{}
+	for _, uri := range confirmed {
+		known[uri] = true
+	}
+	var unconfirmed []string
+	for _, uri := range envelope.Recipients {
+		if !known[uri] {
+			unconfirmed = append(unconfirmed, uri)
+		}
+	}
+	if len(unconfirmed) > 0 {
+		return errors.Errorf("unable to verify the recipients of %s, refusing to seal for %s - confirm them with --recipient, "+
+			"or change them with: sctl rekey --add-recipient", envelope.Filepath, strings.Join(unconfirmed, ", "))
+	}
+	return nil
+}
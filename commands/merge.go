@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// mergeDriverName - the name the merge driver is registered under in git config and
+// .gitattributes
+const mergeDriverName = "sctl"
+
+// jsonEqual - whether two values serialize identically, which unlike reflect.DeepEqual
+// ignores how their times were parsed
+func jsonEqual(a interface{}, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// merge3 - three-way merge of a single value: a change on one side is taken, and changes on
+// both sides must agree. Returns the merged value, the side it was taken from (0 when both
+// agree, 1 for ours, 2 for theirs), and false on a conflict.
+func merge3[T any](base T, ours T, theirs T) (T, int, bool) {
+	switch {
+	case jsonEqual(ours, theirs):
+		return ours, 0, true
+	case jsonEqual(base, ours):
+		return theirs, 2, true
+	case jsonEqual(base, theirs):
+		return ours, 1, true
+	}
+	return ours, 1, false
+}
+
+// sealing - what a secret is sealed for, which must be the same for every secret in an
+// envelope
+type sealing struct {
+	KeyIdentifier string
+	Recipients    []string
+	ID            string
+}
+
+func sealingOf(envelope utils.V2) sealing {
+	return sealing{envelope.KeyIdentifier, envelope.Recipients, envelope.ID}
+}
+
+// findSecret - the named secret, or nil if the envelope does not have it
+func findSecret(secrets utils.Secrets, name string) *utils.Secret {
+	secret, err := secrets.Find(name)
+	if err != nil {
+		return nil
+	}
+	return &secret
+}
+
+// mergeEnvelopes - three-way merge of two envelopes descended from base, secret by secret.
+// Secrets added, removed or changed on one side are taken from that side, and secrets
+// changed on both sides must have been changed identically. A change to the envelope's key,
+// recipients or ID on one side conflicts with secrets changed on the other, as they were
+// sealed for the old ones. Returns the merged envelope, or a description of each conflict,
+// and an error if either side's format version is malformed.
+func mergeEnvelopes(base utils.V2, ours utils.V2, theirs utils.V2) (utils.V2, []string, error) {
+	var conflicts []string
+	merged := ours
+	merged.Secrets = nil
+
+	sides := [3]sealing{{}, sealingOf(ours), sealingOf(theirs)}
+	mergedSealing, _, ok := merge3(sealingOf(base), sides[1], sides[2])
+	if !ok {
+		conflicts = append(conflicts, "the envelope's key, recipients or ID were changed differently on both sides")
+	}
+	merged.KeyIdentifier, merged.Recipients, merged.ID = mergedSealing.KeyIdentifier, mergedSealing.Recipients, mergedSealing.ID
+
+	depth, _, ok := merge3(base.HistoryDepth, ours.HistoryDepth, theirs.HistoryDepth)
+	if !ok {
+		conflicts = append(conflicts, "the history depth was changed differently on both sides")
+	}
+	merged.HistoryDepth = depth
+	newer, err := newerVersion(ours.Version, theirs.Version)
+	if err != nil {
+		return utils.V2{}, nil, err
+	}
+	merged.Version = newer
+
+	// Ours keep their order, followed by secrets only they added
+	var names []string
+	seen := map[string]bool{}
+	for _, secrets := range []utils.Secrets{ours.Secrets, theirs.Secrets, base.Secrets} {
+		for _, secret := range secrets {
+			if !seen[secret.Name] {
+				seen[secret.Name] = true
+				names = append(names, secret.Name)
+			}
+		}
+	}
+	for _, name := range names {
+		secret, side, ok := merge3(findSecret(base.Secrets, name), findSecret(ours.Secrets, name), findSecret(theirs.Secrets, name))
+		switch {
+		case !ok:
+			conflicts = append(conflicts, fmt.Sprintf("%s was changed differently on both sides", name))
+			continue
+		case side != 0 && secret != nil && !jsonEqual(sides[side], mergedSealing):
+			conflicts = append(conflicts, fmt.Sprintf("%s was changed on one side while the other re-keyed the envelope", name))
+			continue
+		}
+		if secret != nil {
+			merged.Secrets = append(merged.Secrets, *secret)
+		}
+	}
+	return merged, conflicts, nil
+}
+
+// newerVersion - the newer of two envelope format versions, compared as numbers. An empty
+// version is that of an envelope that did not exist, or predates versions.
+func newerVersion(ours string, theirs string) (string, error) {
+	var numbers [2]int
+	for i, version := range []string{ours, theirs} {
+		if version == "" {
+			continue
+		}
+		number, err := strconv.Atoi(version)
+		if err != nil {
+			return "", fmt.Errorf("malformed envelope version %q", version)
+		}
+		numbers[i] = number
+	}
+	if numbers[1] > numbers[0] {
+		return theirs, nil
+	}
+	return ours, nil
+}
+
+// readMergeSide - read one version of the envelope handed to the merge driver. git hands
+// over an empty file for a version that did not exist.
+func readMergeSide(path string) (utils.V2, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return utils.V2{}, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return utils.V2{}, nil
+	}
+	envelope, err := utils.ParseEnvelope(data, path)
+	envelope.Filepath = path
+	return envelope, err
+}
+
+// verifiedSide - whether one version of the envelope handed to the merge driver is sealed
+// with a MAC that verifies. A version that can not be verified is merged all the same.
+func verifiedSide(envelope *utils.V2) bool {
+	if err := envelope.VerifyIntegrity(); err != nil {
+		log.Debugf("Unable to verify %s: %v", envelope.Filepath, err)
+		return false
+	}
+	return envelope.Verified()
+}
+
+// installMergeDriver - register the merge driver for envelopes matching pattern, in the
+// git config of the repository in the current directory and in .gitattributes
+func installMergeDriver(pattern string) error {
+	for _, setting := range [][]string{
+		{"merge." + mergeDriverName + ".name", "sctl envelope merge"},
+		{"merge." + mergeDriverName + ".driver", "sctl merge-driver %O %A %B"},
+	} {
+		output, err := exec.Command("git", "config", setting[0], setting[1]).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("unable to set git config %s: %s", setting[0], strings.TrimSpace(string(output)))
+		}
+	}
+
+	attribute := pattern + " merge=" + mergeDriverName
+	existing, err := os.ReadFile(".gitattributes")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	for scanner.Scan() {
+		if strings.Join(strings.Fields(scanner.Text()), " ") == attribute {
+			return nil
+		}
+	}
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		existing = append(existing, '\n')
+	}
+	existing = append(existing, attribute+"\n"...)
+	return errors.Wrap(os.WriteFile(".gitattributes", existing, 0644), "unable to update .gitattributes")
+}
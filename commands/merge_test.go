@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestMergeEnvelopes(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := utils.Secret{Name: "A", Cyphertext: "a", DataKey: "ka", Created: created}
+	b := utils.Secret{Name: "B", Cyphertext: "b", DataKey: "kb", Created: created}
+	c := utils.Secret{Name: "C", Cyphertext: "c", DataKey: "kc", Created: created}
+	a2 := a
+	a2.Cyphertext, a2.Version = "a2", 2
+	a3 := a
+	a3.Cyphertext, a3.Version = "a3", 2
+	envelope := func(key string, secrets ...utils.Secret) utils.V2 {
+		return utils.V2{KeyIdentifier: key, ID: "id", Secrets: secrets}
+	}
+	base := envelope("k1", a, b)
+
+	var testTable = []struct {
+		name      string
+		ours      utils.V2
+		theirs    utils.V2
+		expected  []string
+		conflicts int
+	}{
+		{"Unchanged", base, base, []string{"a", "b"}, 0},
+		{"Added on both sides", envelope("k1", a, b, c), envelope("k1", a, b, utils.Secret{Name: "D"}), []string{"a", "b", "c", ""}, 0},
+		{"Rotated ours, removed theirs", envelope("k1", a2, b), envelope("k1", b), []string{"b"}, 1},
+		{"Rotated theirs, removed ours", envelope("k1", b), envelope("k1", a2, b), []string{"b"}, 1},
+		{"Removed theirs", envelope("k1", a2, b), envelope("k1", a2), []string{"a2"}, 0},
+		{"Rotated identically", envelope("k1", a2, b), envelope("k1", a2, b), []string{"a2", "b"}, 0},
+		{"Rotated differently", envelope("k1", a2, b), envelope("k1", a3, b), []string{"b"}, 1},
+		{"Re-keyed theirs", envelope("k1", a, b), envelope("k2", a3, b), []string{"a3", "b"}, 0},
+		{"Re-keyed theirs, added ours", envelope("k1", a, b, c), envelope("k2", a3, b), []string{"a3", "b"}, 1},
+		{"Re-keyed differently", envelope("k3", a, b), envelope("k2", a, b), []string{"a", "b"}, 1},
+	}
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts, err := mergeEnvelopes(base, tt.ours, tt.theirs)
+			assert.NoError(t, err)
+			assert.Len(t, conflicts, tt.conflicts, conflicts)
+			var cyphertexts []string
+			for _, secret := range merged.Secrets {
+				cyphertexts = append(cyphertexts, secret.Cyphertext)
+			}
+			assert.Equal(t, tt.expected, cyphertexts)
+		})
+	}
+
+	// A change of history depth on one side is taken
+	deeper := base
+	depth := 5
+	deeper.HistoryDepth = &depth
+	merged, conflicts, err := mergeEnvelopes(base, base, deeper)
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, 5, merged.GetHistoryDepth())
+	assert.Equal(t, "k1", merged.KeyIdentifier)
+
+	// An envelope that did not exist at the base is merged as if it was empty
+	merged, conflicts, err = mergeEnvelopes(utils.V2{}, envelope("k1", a), envelope("k1", b))
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Len(t, merged.Secrets, 2)
+}
+
+func TestNewerVersion(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		ours     string
+		theirs   string
+		expected string
+		err      bool
+	}{
+		{"Same", "3", "3", "3", false},
+		{"Theirs newer", "3", "4", "4", false},
+		{"Ours newer", "4", "2", "4", false},
+		{"Compared as numbers", "4", "10", "10", false},
+		{"Ours did not exist", "", "3", "3", false},
+		{"Malformed", "3", "x", "", true},
+	}
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			newer, err := newerVersion(tt.ours, tt.theirs)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, newer)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// defaultConcurrency is the number of secrets processed at once when --concurrency is not set.
+const defaultConcurrency = 8
+
+// concurrencyFlag - shared flag declaration for commands that process secrets in parallel
+var concurrencyFlag = cli.IntFlag{
+	Name:   "concurrency",
+	EnvVar: "SCTL_CONCURRENCY",
+	Usage:  "Number of secrets to process in parallel",
+	Value:  defaultConcurrency,
+}
+
+// mapSecrets - apply fn to every secret, with at most concurrency calls in flight at once.
+// Results are returned in the same order as the secrets they were produced from, so output
+// is deterministic regardless of scheduling. The first error stops any further secrets from
+// being scheduled, and is returned annotated with the name of the secret that failed.
+func mapSecrets[T any](secrets utils.Secrets, concurrency int, fn func(utils.Secret) (T, error)) ([]T, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	results := make([]T, len(secrets))
+	slots := make(chan struct{}, concurrency)
+	failed := make(chan struct{})
+
+schedule:
+	for i, secret := range secrets {
+		select {
+		case <-failed:
+			break schedule
+		case slots <- struct{}{}:
+		}
+		// A slot and a failure may become ready together; never start work after a failure.
+		select {
+		case <-failed:
+			<-slots
+			break schedule
+		default:
+		}
+
+		wg.Add(1)
+		go func(i int, secret utils.Secret) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result, err := fn(secret)
+			if err != nil {
+				once.Do(func() {
+					firstErr = errors.Wrapf(err, "secret %s", secret.Name)
+					close(failed)
+				})
+				return
+			}
+			results[i] = result
+		}(i, secret)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func testSecrets(count int) utils.Secrets {
+	secrets := utils.Secrets{}
+	for i := 0; i < count; i++ {
+		secrets = append(secrets, utils.Secret{Name: fmt.Sprintf("SECRET_%d", i)})
+	}
+	return secrets
+}
+
+// Results must come back in envelope order, no matter which worker finishes first.
+func TestMapSecretsPreservesOrder(t *testing.T) {
+	secrets := testSecrets(50)
+
+	results, err := mapSecrets(secrets, 8, func(s utils.Secret) (string, error) {
+		// shuffle the natural completion order
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		return s.Name, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 50)
+	for i, secret := range secrets {
+		assert.Equal(t, secret.Name, results[i])
+	}
+}
+
+func TestMapSecretsBoundedConcurrency(t *testing.T) {
+	var inFlight, peak int32
+
+	_, err := mapSecrets(testSecrets(40), 4, func(s utils.Secret) (bool, error) {
+		current := atomic.AddInt32(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, peak, int32(4))
+}
+
+func TestMapSecretsFailsFast(t *testing.T) {
+	var calls int32
+
+	_, err := mapSecrets(testSecrets(100), 1, func(s utils.Secret) (bool, error) {
+		atomic.AddInt32(&calls, 1)
+		if s.Name == "SECRET_3" {
+			return false, errors.New("permission denied")
+		}
+		return true, nil
+	})
+	assert.EqualError(t, err, "secret SECRET_3: permission denied")
+	// With a single worker, nothing may be scheduled after the failing secret
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestMapSecretsEmpty(t *testing.T) {
+	results, err := mapSecrets(utils.Secrets{}, 0, func(s utils.Secret) (bool, error) {
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 0)
+}
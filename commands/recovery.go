@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// errUnsealShares - the recovery shares given are not those of the envelope's recovery key
+var errUnsealShares = errors.New("the shares do not unseal this envelope's recovery key")
+
+// recoveryRecipient - the key URI of the envelope's recovery key, if it has one
+func recoveryRecipient(envelope utils.V2) string {
+	for _, uri := range envelope.Recipients {
+		if strings.HasPrefix(uri, cloud.RecoveryScheme) {
+			return uri
+		}
+	}
+	return ""
+}
+
+// parseShares - read hex encoded recovery shares, one per line. Lines may carry the label
+// printed by recovery init (eg: "share 1: 0a1b..."), and blank lines are ignored.
+func parseShares(input []byte) ([][]byte, error) {
+	var shares [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		share, err := hex.DecodeString(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid recovery share on line %q", scanner.Text())
+		}
+		shares = append(shares, share)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed reading recovery shares")
+	}
+	return shares, nil
+}
+
+// scrub - zero key material once it is no longer needed
+func scrub(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/shamir"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestParseShares(t *testing.T) {
+	shares, err := parseShares([]byte("share 1: 0a0b01\n\n  0c0d02  \n"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{0x0a, 0x0b, 0x01}, {0x0c, 0x0d, 0x02}}, shares)
+
+	_, err = parseShares([]byte("share 1: not-hex\n"))
+	assert.Error(t, err)
+}
+
+// An envelope sealed for a recovery key can be decrypted with enough of its shares alone.
+func TestRecoveryUnseal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+	keys := testKeyring(t, 0)
+
+	err := utils.UpdateEnvelope(path, func(envelope *utils.V2) error {
+		secret, err := encryptSecret(ctx, keys, envelope.ID, "DB_PASSWORD", []byte("hunter2"), "plain")
+		envelope.KeyIdentifier = keys.keyURI
+		envelope.Secrets.Add(secret)
+		return err
+	})
+	assert.NoError(t, err)
+
+	privateKey, recoveryURI, err := cloud.GenerateRecoveryKey()
+	assert.NoError(t, err)
+	shares, err := shamir.Split(privateKey, 3, 2)
+	assert.NoError(t, err)
+
+	newKeys := testKeyringOf(t, keys.keyURI, recoveryURI)
+	_, err = rekeyEnvelope(ctx, path, fixedKeyrings(keys, newKeys), rekeyOptions{concurrency: 2})
+	assert.NoError(t, err)
+
+	envelope, err := utils.ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.Equal(t, recoveryURI, recoveryRecipient(envelope))
+	assert.Equal(t, utils.CurrentVersion, envelope.Version)
+
+	// Recover with two of the printed shares
+	var printed []string
+	for i, share := range shares[1:] {
+		printed = append(printed, fmt.Sprintf("share %d: %s", i+2, hex.EncodeToString(share)))
+	}
+	parsed, err := parseShares([]byte(strings.Join(printed, "\n")))
+	assert.NoError(t, err)
+	combined, err := shamir.Combine(parsed)
+	assert.NoError(t, err)
+	client, unsealedURI, err := cloud.UnsealRecoveryKey(combined)
+	assert.NoError(t, err)
+	assert.Equal(t, recoveryURI, unsealedURI)
+
+	recovery := newRecoveryKeyring(envelope.KeyIdentifier, unsealedURI, client)
+	defer recovery.Close()
+	plaintext, err := decryptSecret(ctx, recovery, envelope.ID, envelope.Secrets[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), plaintext)
+
+	// The sealed recovery key alone can not decrypt
+	sealed := testKeyringOf(t, recoveryURI)
+	sealed.keyURI = envelope.KeyIdentifier
+	_, err = decryptSecret(ctx, sealed, envelope.ID, envelope.Secrets[0])
+	assert.Error(t, err)
+}
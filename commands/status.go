@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vapor-ware/sctl/cloud"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+// versionGroup - the names of the secrets whose data keys were wrapped by a key version.
+// Previous values kept in a secret's history are named with their version, eg: FOO (version 2)
+type versionGroup struct {
+	version string
+	names   []string
+}
+
+// primaryVersion - the key version new secrets are sealed with, for KMS clients that report
+// versions. Returns an empty string for keys that are not versioned.
+func primaryVersion(ctx context.Context, client cloud.KMS) (string, error) {
+	versioner, ok := client.(cloud.KeyVersioner)
+	if !ok {
+		return "", nil
+	}
+	return versioner.PrimaryVersion(ctx)
+}
+
+// staleSecret - match secrets with a value, current or kept in their history, not sealed
+// with the primary key version, including those sealed before key versions were recorded.
+func staleSecret(primary string) func(utils.Secret) bool {
+	return func(secret utils.Secret) bool {
+		if secret.KeyVersion != primary {
+			return true
+		}
+		for _, previous := range secret.History {
+			if previous.KeyVersion != primary {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// groupByVersion - group secret names by the key version that sealed them, ordered by
+// version with secrets of an unknown version last. A secret is listed under the version of
+// each of its values, current or kept in its history.
+func groupByVersion(secrets utils.Secrets) []versionGroup {
+	names := map[string][]string{}
+	for _, secret := range secrets {
+		names[secret.KeyVersion] = append(names[secret.KeyVersion], secret.Name)
+		for _, previous := range secret.History {
+			name := fmt.Sprintf("%s (version %d)", secret.Name, previous.VersionNumber())
+			names[previous.KeyVersion] = append(names[previous.KeyVersion], name)
+		}
+	}
+	var groups []versionGroup
+	for version, group := range names {
+		sort.Strings(group)
+		groups = append(groups, versionGroup{version: version, names: group})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].version == "" || groups[j].version == "" {
+			return groups[j].version == ""
+		}
+		return versionLess(groups[i].version, groups[j].version)
+	})
+	return groups
+}
+
+// versionLess - order key versions by their numeric suffix, eg: .../cryptoKeyVersions/10
+// after .../cryptoKeyVersions/9, falling back to the names of versions that are not numbered.
+func versionLess(a string, b string) bool {
+	numberA, errA := strconv.Atoi(a[strings.LastIndex(a, "/")+1:])
+	numberB, errB := strconv.Atoi(b[strings.LastIndex(b, "/")+1:])
+	if errA != nil || errB != nil || numberA == numberB {
+		return a < b
+	}
+	return numberA < numberB
+}
+
+// versionLabel - describe a key version relative to the primary version
+func versionLabel(version string, primary string) string {
+	label := version
+	if version == "" {
+		label = "unknown version"
+	}
+	switch {
+	case primary == "":
+		return label
+	case version == primary:
+		return label + " (primary)"
+	default:
+		return label + " (stale)"
+	}
+}
+
+// printStatus - list secrets grouped by key version
+func printStatus(w io.Writer, keyURI string, primary string, secrets utils.Secrets) {
+	fmt.Fprintf(w, "Key: %s\n", keyURI)
+	if primary != "" {
+		fmt.Fprintf(w, "Primary version: %s\n", primary)
+	}
+	for _, group := range groupByVersion(secrets) {
+		fmt.Fprintf(w, "\n%s:\n", versionLabel(group.version, primary))
+		for _, name := range group.names {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vapor-ware/sctl/utils"
+)
+
+func TestGroupByVersion(t *testing.T) {
+	secrets := utils.Secrets{
+		{Name: "LEGACY"},
+		{Name: "B", KeyVersion: "key/cryptoKeyVersions/2"},
+		{Name: "C", KeyVersion: "key/cryptoKeyVersions/1"},
+		{Name: "A", KeyVersion: "key/cryptoKeyVersions/2"},
+	}
+	assert.Equal(t, []versionGroup{
+		{version: "key/cryptoKeyVersions/1", names: []string{"C"}},
+		{version: "key/cryptoKeyVersions/2", names: []string{"A", "B"}},
+		{version: "", names: []string{"LEGACY"}},
+	}, groupByVersion(secrets))
+
+	assert.Empty(t, groupByVersion(nil))
+
+	// Versions are ordered by number, not as strings
+	secrets = utils.Secrets{
+		{Name: "TEN", KeyVersion: "key/cryptoKeyVersions/10"},
+		{Name: "NINE", KeyVersion: "key/cryptoKeyVersions/9"},
+	}
+	assert.Equal(t, []versionGroup{
+		{version: "key/cryptoKeyVersions/9", names: []string{"NINE"}},
+		{version: "key/cryptoKeyVersions/10", names: []string{"TEN"}},
+	}, groupByVersion(secrets))
+
+	// Previous values are listed under the version that sealed them
+	secrets = utils.Secrets{
+		{Name: "A", KeyVersion: "key/cryptoKeyVersions/2", Version: 3, History: []utils.Secret{
+			{Name: "A", KeyVersion: "key/cryptoKeyVersions/2", Version: 2},
+			{Name: "A", KeyVersion: "key/cryptoKeyVersions/1"},
+		}},
+	}
+	assert.Equal(t, []versionGroup{
+		{version: "key/cryptoKeyVersions/1", names: []string{"A (version 1)"}},
+		{version: "key/cryptoKeyVersions/2", names: []string{"A", "A (version 2)"}},
+	}, groupByVersion(secrets))
+}
+
+func TestStaleSecret(t *testing.T) {
+	primary := "key/cryptoKeyVersions/2"
+	var testTable = []struct {
+		name     string
+		secret   utils.Secret
+		expected bool
+	}{
+		{"Primary", utils.Secret{KeyVersion: primary}, false},
+		{"Stale", utils.Secret{KeyVersion: "key/cryptoKeyVersions/1"}, true},
+		{"Unknown Version", utils.Secret{}, true},
+		{"Primary History", utils.Secret{KeyVersion: primary, History: []utils.Secret{{KeyVersion: primary}}}, false},
+		{"Stale History", utils.Secret{KeyVersion: primary, History: []utils.Secret{{KeyVersion: "key/cryptoKeyVersions/1"}}}, true},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, staleSecret(primary)(tt.secret))
+		})
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		a        string
+		b        string
+		expected bool
+	}{
+		{"Numeric", "key/cryptoKeyVersions/9", "key/cryptoKeyVersions/10", true},
+		{"Numeric Reversed", "key/cryptoKeyVersions/10", "key/cryptoKeyVersions/9", false},
+		{"Same Number", "a/cryptoKeyVersions/1", "b/cryptoKeyVersions/1", true},
+		{"Unnumbered", "alias/b", "alias/a", false},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, versionLess(tt.a, tt.b))
+		})
+	}
+}
+
+func TestVersionLabel(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		version  string
+		primary  string
+		expected string
+	}{
+		{"Primary", "v2", "v2", "v2 (primary)"},
+		{"Stale", "v1", "v2", "v1 (stale)"},
+		{"Unknown Stale", "", "v2", "unknown version (stale)"},
+		{"Unversioned Key", "", "", "unknown version"},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, versionLabel(tt.version, tt.primary))
+		})
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/fatih/color"
 	"github.com/tcnksm/go-latest"
 	"github.com/urfave/cli"
+	"github.com/vapor-ware/sctl/cloud"
 	"github.com/vapor-ware/sctl/commands"
+	"github.com/vapor-ware/sctl/utils"
 	"github.com/vapor-ware/sctl/version"
 )
 
@@ -23,6 +26,18 @@ func main() {
 			EnvVar: "SCTL_DEBUG",
 			Usage:  "Enable debug logging statements",
 		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			EnvVar: "SCTL_TIMEOUT",
+			Usage:  "Maximum time to spend on KMS operations, including retries (0 to wait indefinitely)",
+			Value:  5 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "lock-timeout",
+			EnvVar: "SCTL_LOCK_TIMEOUT",
+			Usage:  "Maximum time to wait for another sctl process to finish writing the envelope",
+			Value:  utils.LockTimeout,
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -30,6 +45,8 @@ func main() {
 		if c.Bool("debug") {
 			log.SetLevel(log.DebugLevel)
 		}
+		utils.LockTimeout = c.Duration("lock-timeout")
+		utils.EnvelopeIntegrity = commands.EnvelopeIntegrity(c.Duration("timeout"))
 		return nil
 	}
 
@@ -57,6 +74,7 @@ func main() {
 	}
 
 	app.Commands = commands.BuildContextualMenu()
+	cloud.RegisterStateManagers()
 
 	err := app.Run(os.Args)
 	if err != nil {
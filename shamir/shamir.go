@@ -0,0 +1,143 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8), splitting a secret into
+// shares of which any threshold number reconstruct it, while fewer reveal nothing.
+//
+// Each share is the secret's length plus one byte: the value of a random polynomial for
+// every byte of the secret, followed by the x coordinate the polynomials were evaluated at.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Split divides secret into parts shares, any threshold of which can be combined to
+// recover it. The threshold must be at least 2, and parts may not exceed 255.
+func Split(secret []byte, parts int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if parts < threshold {
+		return nil, errors.New("parts cannot be less than the threshold")
+	}
+	if parts > 255 {
+		return nil, errors.New("parts cannot exceed 255")
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		// x coordinates start at 1, as the secret is the polynomial's value at 0
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, value := range secret {
+		coefficients[0] = value
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[idx] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from shares produced by Split. It can not detect that fewer
+// than the threshold number of shares were given, in which case the result is garbage.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("shares are too short")
+	}
+
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares must all be the same length")
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("share %d is invalid or duplicated", i+1)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-1)
+	ys := make([]byte, len(shares))
+	for idx := range secret {
+		for i, share := range shares {
+			ys[i] = share[idx]
+		}
+		secret[idx] = interpolate(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate returns the value of the polynomial with the given coefficients at x, using
+// Horner's method.
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// interpolate returns the value at 0 of the polynomial passing through the points xs, ys
+// using Lagrange interpolation.
+func interpolate(xs []byte, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// subtraction is addition (xor) in GF(2^8)
+			basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+		}
+		result ^= mul(ys[i], basis)
+	}
+	return result
+}
+
+// mul multiplies two elements of GF(2^8), reducing by the AES polynomial x^8+x^4+x^3+x+1.
+func mul(a byte, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// div divides a by the non-zero element b of GF(2^8).
+func div(a byte, b byte) byte {
+	// b^254 is the multiplicative inverse of b, as b^255 = 1
+	inverse := b
+	for i := 0; i < 253; i++ {
+		inverse = mul(inverse, b)
+	}
+	return mul(a, inverse)
+}
@@ -0,0 +1,99 @@
+package shamir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("a recovery key of some 32 bytes!")
+
+	shares, err := Split(secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 5)
+	for _, share := range shares {
+		assert.Len(t, share, len(secret)+1)
+	}
+
+	var testTable = []struct {
+		name    string
+		indexes []int
+	}{
+		{"First Three", []int{0, 1, 2}},
+		{"Last Three", []int{2, 3, 4}},
+		{"Out Of Order", []int{4, 0, 2}},
+		{"All", []int{0, 1, 2, 3, 4}},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			var subset [][]byte
+			for _, i := range tt.indexes {
+				subset = append(subset, shares[i])
+			}
+			combined, err := Combine(subset)
+			assert.NoError(t, err)
+			assert.Equal(t, secret, combined)
+		})
+	}
+
+	// Too few shares do not reveal the secret
+	combined, err := Combine(shares[:2])
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, combined)
+}
+
+func TestSplitErrors(t *testing.T) {
+	var testTable = []struct {
+		name      string
+		secret    []byte
+		parts     int
+		threshold int
+	}{
+		{"Empty Secret", nil, 5, 3},
+		{"Threshold Too Low", []byte("secret"), 5, 1},
+		{"Threshold Above Parts", []byte("secret"), 2, 3},
+		{"Too Many Parts", []byte("secret"), 256, 3},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Split(tt.secret, tt.parts, tt.threshold)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	var testTable = []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"Single Share", shares[:1]},
+		{"Duplicate Share", [][]byte{shares[0], shares[0]}},
+		{"Mismatched Lengths", [][]byte{shares[0], shares[1][1:]}},
+		{"Too Short", [][]byte{{1}, {2}}},
+		{"Zero Coordinate", [][]byte{{1, 0}, {2, 1}}},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Combine(tt.shares)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), div(byte(a), byte(a)))
+		assert.Equal(t, byte(a), mul(byte(a), 1))
+		assert.Equal(t, byte(0), mul(byte(a), 0))
+	}
+	// Known product from FIPS-197
+	assert.Equal(t, byte(0xc1), mul(0x57, 0x83))
+}
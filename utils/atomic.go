@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// BackupSuffix is appended to an envelope's path to name the copy of its previous version
+// retained by WriteFileAtomic, eg: .scuttle.json.bak
+const BackupSuffix = ".bak"
+
+// WriteFileAtomic replaces the file at path with data, such that a crash or interrupt part
+// way through leaves either the old or the new file in place, never a truncated one. The
+// data is written to a temporary file in the same directory, synced to disk, and renamed
+// over path.
+// When path already exists its mode and, where permitted, ownership are preserved, and its
+// previous contents are kept alongside it with BackupSuffix. New files are created with perm.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		perm = info.Mode().Perm()
+		previous, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(path+BackupSuffix, previous, perm, info); err != nil {
+			return errors.Wrapf(err, "failed to back up %s", path)
+		}
+	case os.IsNotExist(err):
+		info = nil
+	default:
+		return err
+	}
+	return replaceFile(path, data, perm, info)
+}
+
+// replaceFile writes data to a temporary file next to path and renames it into place. The
+// file is given perm, and the ownership of owner when it is not nil.
+func replaceFile(path string, data []byte, perm os.FileMode, owner os.FileInfo) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err = chownLike(tmp.Name(), owner); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
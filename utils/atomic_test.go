@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".scuttle.json")
+
+	// A new file has no backup
+	err := WriteFileAtomic(path, []byte("first"), 0600)
+	assert.NoError(t, err)
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), contents)
+	_, err = os.Stat(path + BackupSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// Replacing keeps the previous version and the file mode
+	err = os.Chmod(path, 0640)
+	assert.NoError(t, err)
+	err = WriteFileAtomic(path, []byte("second"), 0600)
+	assert.NoError(t, err)
+	contents, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), contents)
+	backup, err := os.ReadFile(path + BackupSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), backup)
+
+	if runtime.GOOS != "windows" {
+		for _, name := range []string{path, path + BackupSuffix} {
+			info, err := os.Stat(name)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), name)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", ".scuttle.json")
+	err := WriteFileAtomic(path, []byte("data"), 0600)
+	assert.Error(t, err)
+}
+
+// Saving an envelope keeps the previous version as a backup.
+func TestV2SaveBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+	envelope := V2{KeyIdentifier: "local:///tmp/test.key", Filepath: path}
+	envelope.Secrets.Add(Secret{Name: "FIRST"})
+	assert.NoError(t, envelope.Save())
+
+	envelope.Secrets.Add(Secret{Name: "SECOND"})
+	assert.NoError(t, envelope.Save())
+
+	previous := V2{Filepath: path + BackupSuffix}
+	assert.NoError(t, previous.Load())
+	assert.Len(t, previous.Secrets, 1)
+
+	current := V2{Filepath: path}
+	assert.NoError(t, current.Load())
+	assert.Len(t, current.Secrets, 2)
+}
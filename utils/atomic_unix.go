@@ -0,0 +1,37 @@
+//go:build !windows
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chownLike gives the file at path the owner and group of the file described by like.
+// Only privileged users may give a file away, so a refusal is logged rather than failing
+// the write.
+func chownLike(path string, like os.FileInfo) error {
+	stat, ok := like.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := os.Chown(path, int(stat.Uid), int(stat.Gid))
+	if errors.Is(err, syscall.EPERM) {
+		log.Debugf("unable to preserve ownership of %s: %v", path, err)
+		return nil
+	}
+	return err
+}
+
+// syncDir flushes a directory entry, so a rename within it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+)
+
+// chownLike is a no-op, as Windows files do not carry POSIX ownership.
+func chownLike(path string, like os.FileInfo) error {
+	return nil
+}
+
+// syncDir is a no-op, as Windows can not sync a directory handle.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// locationSeparator splits an envelope URL into its backend scheme and location.
+const locationSeparator = "://"
+
+// ErrEnvelopeChanged is returned when an envelope is saved to a remote backend after
+// someone else changed it there, as the save would otherwise drop their changes.
+var ErrEnvelopeChanged = errors.New("envelope changed remotely since it was read, re-run the command to apply it to the latest version")
+
+// EnvelopeStateManager is the StateManager of V2 envelopes, which stores them serialized,
+// locally or in a remote backend. Envelopes are located by a path, or by a URL whose scheme
+// selects the backend, eg: gs://bucket/.scuttle.json
+//
+// Reading returns a revision of the envelope, which is handed back when writing it. Remote
+// backends only write if the envelope is still at that revision, failing with
+// ErrEnvelopeChanged otherwise, so concurrent writers do not drop each other's changes. An
+// empty revision is that of an envelope that did not exist.
+type EnvelopeStateManager interface {
+	// ReadEnvelope returns the serialized envelope and its revision. A missing envelope is
+	// reported with an error satisfying os.IsNotExist.
+	ReadEnvelope() ([]byte, string, error)
+	// WriteEnvelope replaces the envelope at revision, returning its new revision.
+	WriteEnvelope(data []byte, revision string) (string, error)
+	// Lock takes an exclusive lock on the envelope, for backends that support one, until
+	// the returned function is called.
+	Lock() (func() error, error)
+	// String describes the envelope's location, for messages.
+	String() string
+}
+
+// StateManagerFactory creates the EnvelopeStateManager for an envelope URL.
+type StateManagerFactory func(location string) (EnvelopeStateManager, error)
+
+var (
+	stateManagersMu sync.RWMutex
+	stateManagers   = map[string]StateManagerFactory{
+		"file": func(location string) (EnvelopeStateManager, error) {
+			return NewFileStateManager(strings.TrimPrefix(location, "file"+locationSeparator)), nil
+		},
+		"http":  NewHTTPStateManager,
+		"https": NewHTTPStateManager,
+	}
+)
+
+// RegisterStateManager makes a backend available for envelope URLs using the given scheme.
+// Registering a scheme that already exists replaces the previous backend.
+func RegisterStateManager(scheme string, factory StateManagerFactory) {
+	stateManagersMu.Lock()
+	defer stateManagersMu.Unlock()
+	stateManagers[scheme] = factory
+}
+
+// NewEnvelopeStateManager returns the EnvelopeStateManager for an envelope location: a path
+// to the envelope or its directory, or a URL, eg: file://, gs:// or https://
+func NewEnvelopeStateManager(location string) (EnvelopeStateManager, error) {
+	idx := strings.Index(location, locationSeparator)
+	if idx < 0 {
+		return NewFileStateManager(location), nil
+	}
+	scheme := location[:idx]
+
+	stateManagersMu.RLock()
+	factory, found := stateManagers[scheme]
+	var schemes []string
+	for known := range stateManagers {
+		schemes = append(schemes, known+locationSeparator)
+	}
+	stateManagersMu.RUnlock()
+	if !found {
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("unsupported envelope location %q - use a path, or one of %s", location, strings.Join(schemes, ", "))
+	}
+	return factory(location)
+}
+
+// notExist reports an envelope missing from a remote backend, such that os.IsNotExist
+// recognizes it.
+func notExist(location string) error {
+	return &os.PathError{Op: "read", Path: location, Err: os.ErrNotExist}
+}
+
+// FileStateManager stores an envelope in a local file, which is replaced atomically and
+// kept as a backup each time it is written. Writers serialize on a lock file beside the
+// envelope rather than by revision.
+type FileStateManager struct {
+	path string
+}
+
+// NewFileStateManager is a factory method to initialize a FileStateManager for the envelope
+// at path, or in the directory at path. If no path is provided, it will default to
+// ".scuttle.json"
+func NewFileStateManager(path string) FileStateManager {
+	if path == "" {
+		path = defaultFile
+	}
+	return FileStateManager{path: path}
+}
+
+// resolve returns the path of the envelope file, which may not exist yet.
+func (fsm FileStateManager) resolve() (string, error) {
+	resolved, err := getEnvelopePath(fsm.path)
+	if os.IsNotExist(err) {
+		// First run - the envelope is about to be created
+		return fsm.path, nil
+	}
+	return resolved, err
+}
+
+// ReadEnvelope reads the envelope file. Files have no revision, as their writers lock.
+func (fsm FileStateManager) ReadEnvelope() ([]byte, string, error) {
+	path, err := getEnvelopePath(fsm.path)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(path)
+	return data, "", err
+}
+
+// WriteEnvelope replaces the envelope file atomically, keeping the previous one as a backup.
+func (fsm FileStateManager) WriteEnvelope(data []byte, revision string) (string, error) {
+	path, err := fsm.resolve()
+	if err != nil {
+		return "", err
+	}
+	return "", WriteFileAtomic(path, data, os.FileMode(0660))
+}
+
+// Lock takes the advisory lock on the envelope file, waiting up to LockTimeout.
+func (fsm FileStateManager) Lock() (func() error, error) {
+	path, err := fsm.resolve()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockEnvelope(path)
+	if err != nil {
+		return nil, err
+	}
+	return lock.Unlock, nil
+}
+
+func (fsm FileStateManager) String() string {
+	return fsm.path
+}
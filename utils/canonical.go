@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Canonical serializes the envelope in its canonical form: secrets sorted by name, fields in
+// the order they are declared, indented, and ending with a newline. An envelope always
+// serializes the same way however its secrets were added, so it only diffs where it changed.
+func (s V2) Canonical() ([]byte, error) {
+	s.Secrets = append(Secrets{}, s.Secrets...)
+	sort.SliceStable(s.Secrets, func(i, j int) bool { return s.Secrets[i].Name < s.Secrets[j].Name })
+	data, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// FormatEnvelope rewrites the envelope at location in its canonical form, see V2.Canonical,
+// returning whether it was not already canonical. With check set, nothing is written. The
+// envelope is neither verified nor resealed, as its MAC does not depend on its formatting.
+func FormatEnvelope(location string, check bool) (bool, error) {
+	manager, err := NewEnvelopeStateManager(location)
+	if err != nil {
+		return false, err
+	}
+	if !check {
+		unlock, err := manager.Lock()
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+
+	data, revision, err := manager.ReadEnvelope()
+	if err != nil {
+		return false, err
+	}
+	contents, err := parseEnvelope(data, manager.String())
+	if err != nil {
+		return false, err
+	}
+	if contents.Version == "" {
+		return false, fmt.Errorf("envelope %s is in the V1 format - upgrade it with: sctl migrate", manager)
+	}
+	canonical, err := contents.Canonical()
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(data, canonical) {
+		return false, nil
+	}
+	if !check {
+		if _, err := manager.WriteEnvelope(canonical, revision); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
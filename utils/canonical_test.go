@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonical(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	envelope := V2{KeyIdentifier: "key", Version: "2", Secrets: Secrets{
+		{Name: "B", Cyphertext: "b", Created: created},
+		{Name: "A", Cyphertext: "a", Created: created},
+	}}
+
+	data, err := envelope.Canonical()
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+ "key_uri": "key",
+ "version": "2",
+ "secrets": [
+  {
+   "name": "A",
+   "cypher": "a",
+   "created": "2020-01-01T00:00:00Z",
+   "encoding": ""
+  },
+  {
+   "name": "B",
+   "cypher": "b",
+   "created": "2020-01-01T00:00:00Z",
+   "encoding": ""
+  }
+ ]
+}
+`, string(data))
+	// The envelope itself is left in order
+	assert.Equal(t, "B", envelope.Secrets[0].Name)
+
+	// Rotating a secret does not move it
+	envelope.Secrets.Add(Secret{Name: "B", Cyphertext: "b2", Created: created})
+	assert.Equal(t, "b2", envelope.Secrets[0].Cyphertext)
+	rotated, err := envelope.Canonical()
+	assert.NoError(t, err)
+	envelope.Secrets[0], envelope.Secrets[1] = envelope.Secrets[1], envelope.Secrets[0]
+	swapped, err := envelope.Canonical()
+	assert.NoError(t, err)
+	assert.Equal(t, rotated, swapped)
+}
+
+func TestFormatEnvelope(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+	envelope := V2{KeyIdentifier: "key", Version: "2", Filepath: path, Secrets: Secrets{{Name: "B"}, {Name: "A"}}}
+	compact, err := json.Marshal(envelope)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, compact, 0600))
+
+	changed, err := FormatEnvelope(path, true)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, compact, data)
+
+	changed, err = FormatEnvelope(path, false)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	canonical, err := envelope.Canonical()
+	assert.NoError(t, err)
+	assert.Equal(t, canonical, data)
+
+	changed, err = FormatEnvelope(path, true)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// Saving writes canonical envelopes
+	assert.NoError(t, envelope.Save())
+	changed, err = FormatEnvelope(path, true)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// V1 envelopes are left for migrate
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "A"}]`), 0600))
+	_, err = FormatEnvelope(path, false)
+	assert.Error(t, err)
+	_, err = FormatEnvelope(filepath.Join(t.TempDir(), "missing.json"), true)
+	assert.True(t, os.IsNotExist(err))
+}
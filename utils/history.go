@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultHistoryDepth is the number of previous values kept for each secret, for envelopes
+// that do not set their own depth.
+const DefaultHistoryDepth = 5
+
+// GetHistoryDepth returns the number of previous values kept for each secret.
+func (s V2) GetHistoryDepth() int {
+	if s.HistoryDepth == nil {
+		return DefaultHistoryDepth
+	}
+	return *s.HistoryDepth
+}
+
+// SetHistoryDepth sets the number of previous values kept for each secret, discarding any
+// history beyond it.
+func (s *V2) SetHistoryDepth(depth int) error {
+	if depth < 0 {
+		return fmt.Errorf("invalid history depth %d", depth)
+	}
+	s.HistoryDepth = &depth
+	for i := range s.Secrets {
+		s.Secrets[i].History = trimHistory(s.Secrets[i].History, depth)
+	}
+	return nil
+}
+
+// VersionNumber returns the version of the secret's value, counting from 1 as it is
+// replaced. Secrets added before versions were tracked are version 1.
+func (s Secret) VersionNumber() int {
+	if s.Version == 0 {
+		return 1
+	}
+	return s.Version
+}
+
+// FindVersion returns the secret as it was at the numbered version, which may be its
+// current value or one kept in its history.
+func (s Secret) FindVersion(version int) (Secret, error) {
+	if version == s.VersionNumber() {
+		return s, nil
+	}
+	for _, previous := range s.History {
+		if previous.VersionNumber() == version {
+			return previous, nil
+		}
+	}
+	return Secret{}, fmt.Errorf("version %d of %s not found", version, s.Name)
+}
+
+// Replacing returns the secret as the new value of previous. It keeps the creation time
+// and metadata of previous, is marked as updated when it was created, and takes the next
+// version number. The value of previous is added to the history, which is limited to
+// depth entries.
+func (s Secret) Replacing(previous Secret, depth int) Secret {
+	updated := s.Created
+	s.Metadata = previous.Metadata
+	s.Metadata.Updated = &updated
+	s.Created = previous.Created
+	s.Version = previous.VersionNumber() + 1
+	s.History = trimHistory(append([]Secret{previous.historyEntry()}, previous.History...), depth)
+	return s
+}
+
+// RollingBack returns the secret with the value it had at the numbered version restored
+// as a new version, as though it was added again at the given time.
+func (s Secret) RollingBack(version int, at time.Time, depth int) (Secret, error) {
+	if version == s.VersionNumber() {
+		return Secret{}, fmt.Errorf("version %d is already the current value of %s", version, s.Name)
+	}
+	restored, err := s.FindVersion(version)
+	if err != nil {
+		return Secret{}, err
+	}
+	restored.Created = at
+	return restored.Replacing(s, depth), nil
+}
+
+// historyEntry returns the value of the secret, as kept in the history of later values.
+// The entry is dated when the value was set.
+func (s Secret) historyEntry() Secret {
+	entry := s
+	if s.Updated != nil {
+		entry.Created = *s.Updated
+	}
+	entry.Version = s.VersionNumber()
+	entry.Metadata = Metadata{}
+	entry.History = nil
+	return entry
+}
+
+// trimHistory limits history to its newest depth entries.
+func trimHistory(history []Secret, depth int) []Secret {
+	if len(history) <= depth {
+		return history
+	}
+	if depth == 0 {
+		return nil
+	}
+	return history[:depth]
+}
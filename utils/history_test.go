@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRotations adds a secret, then replaces it count times a day apart.
+func testRotations(count int, depth int) Secret {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	secret := Secret{Name: "A", Cyphertext: "v1", Created: created, Metadata: NewMetadata(created, "jdoe")}
+	for i := 2; i <= count+1; i++ {
+		next := Secret{Name: "A", Cyphertext: "v" + string(rune('0'+i)), Created: created.AddDate(0, 0, i-1)}
+		secret = next.Replacing(secret, depth)
+	}
+	return secret
+}
+
+func TestReplacingHistory(t *testing.T) {
+	secret := testRotations(3, 5)
+	assert.Equal(t, 4, secret.Version)
+	assert.Equal(t, "v4", secret.Cyphertext)
+	assert.Len(t, secret.History, 3)
+	for i, previous := range secret.History {
+		version := 3 - i
+		assert.Equal(t, version, previous.Version)
+		assert.Equal(t, fmt.Sprintf("v%d", version), previous.Cyphertext)
+		assert.Equal(t, time.Date(2020, 1, version, 0, 0, 0, 0, time.UTC), previous.Created)
+		assert.True(t, previous.Metadata.IsZero())
+		assert.Nil(t, previous.History)
+	}
+
+	// History is limited to the depth
+	secret = testRotations(4, 2)
+	assert.Equal(t, 5, secret.Version)
+	assert.Len(t, secret.History, 2)
+	assert.Equal(t, 4, secret.History[0].Version)
+	assert.Equal(t, 3, secret.History[1].Version)
+
+	secret = testRotations(2, 0)
+	assert.Nil(t, secret.History)
+}
+
+func TestFindVersion(t *testing.T) {
+	secret := testRotations(2, 5)
+
+	current, err := secret.FindVersion(3)
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", current.Cyphertext)
+	first, err := secret.FindVersion(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", first.Cyphertext)
+	_, err = secret.FindVersion(4)
+	assert.EqualError(t, err, "version 4 of A not found")
+
+	// Secrets from before versions were tracked are version 1
+	legacy := Secret{Name: "B"}
+	found, err := legacy.FindVersion(1)
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, found)
+}
+
+func TestRollingBack(t *testing.T) {
+	secret := testRotations(2, 5)
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	restored, err := secret.RollingBack(1, at, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, restored.Version)
+	assert.Equal(t, "v1", restored.Cyphertext)
+	assert.Equal(t, at, *restored.Updated)
+	assert.Equal(t, "jdoe", restored.CreatedBy)
+	assert.Equal(t, secret.Created, restored.Created)
+	assert.Len(t, restored.History, 3)
+	assert.Equal(t, "v3", restored.History[0].Cyphertext)
+
+	_, err = secret.RollingBack(3, at, 5)
+	assert.Error(t, err)
+	_, err = secret.RollingBack(9, at, 5)
+	assert.Error(t, err)
+}
+
+func TestSetHistoryDepth(t *testing.T) {
+	envelope := V2{Secrets: Secrets{testRotations(3, 5)}}
+	assert.Equal(t, DefaultHistoryDepth, envelope.GetHistoryDepth())
+
+	assert.NoError(t, envelope.SetHistoryDepth(1))
+	assert.Equal(t, 1, envelope.GetHistoryDepth())
+	assert.Len(t, envelope.Secrets[0].History, 1)
+	assert.Equal(t, "3", envelope.GetVersion())
+
+	assert.Error(t, envelope.SetHistoryDepth(-1))
+}
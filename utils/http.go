@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// StateTokenVar names the environment variable holding a bearer token, sent with every
+// request to an HTTP envelope backend.
+const StateTokenVar = "SCTL_STATE_TOKEN"
+
+// httpStateTimeout bounds each request to an HTTP envelope backend.
+var httpStateTimeout = time.Minute
+
+// httpLockPollInterval is how often a held HTTP envelope lock is retried while waiting.
+var httpLockPollInterval = time.Second
+
+// HTTPStateManager stores an envelope at an HTTP(S) URL, on any server implementing this
+// protocol against that URL:
+//
+//   - GET returns the envelope with an ETag header, or 404 if it does not exist yet.
+//   - PUT replaces the envelope with the request body. It carries If-Match with the ETag the
+//     envelope was read at, or If-None-Match: * when it did not exist, and the server must
+//     answer 412 Precondition Failed (or 409 Conflict) if that no longer holds.
+//   - LOCK and UNLOCK, which are optional, take and release an exclusive lock for the
+//     duration of a command. Both send an httpLockInfo body identifying the holder. LOCK is
+//     answered 423 Locked (or 409 Conflict) with the current holder's httpLockInfo while
+//     someone else holds the lock, and a server that does not lock answers 405 Method Not
+//     Allowed or 501 Not Implemented, leaving the envelope protected by its ETag alone.
+//
+// Every request carries a bearer token from StateTokenVar when it is set, or basic
+// credentials given in the URL.
+type HTTPStateManager struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPStateManager is a factory method to initialize an HTTPStateManager for an http://
+// or https:// envelope URL.
+func NewHTTPStateManager(location string) (EnvelopeStateManager, error) {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid envelope URL %q", location)
+	}
+	return HTTPStateManager{
+		url:    location,
+		client: &http.Client{Timeout: httpStateTimeout},
+	}, nil
+}
+
+// do sends a request for the envelope, with the bearer token if one is set.
+func (hsm HTTPStateManager) do(method string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, hsm.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token := os.Getenv(StateTokenVar); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := hsm.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to %s envelope %s", method, hsm)
+	}
+	return resp, nil
+}
+
+// ReadEnvelope fetches the envelope, with its ETag as the revision.
+func (hsm HTTPStateManager) ReadEnvelope() ([]byte, string, error) {
+	resp, err := hsm.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", notExist(hsm.String())
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("unexpected status reading envelope %s: %s", hsm, resp.Status)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return nil, "", fmt.Errorf("envelope %s was served without an ETag, so can not be safely updated", hsm)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed reading envelope %s", hsm)
+	}
+	return data, etag, nil
+}
+
+// WriteEnvelope uploads the envelope if it is still at revision.
+func (hsm HTTPStateManager) WriteEnvelope(data []byte, revision string) (string, error) {
+	header := http.Header{"Content-Type": {"application/json"}}
+	if revision == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", revision)
+	}
+	resp, err := hsm.do(http.MethodPut, data, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		return "", errors.Wrapf(ErrEnvelopeChanged, "not saving %s", hsm)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("unexpected status writing envelope %s: %s", hsm, resp.Status)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// httpLockInfo identifies the holder of an HTTP envelope lock.
+type httpLockInfo struct {
+	ID      string    `json:"id"`
+	Who     string    `json:"who"`
+	PID     int       `json:"pid"`
+	Created time.Time `json:"created"`
+}
+
+// newHTTPLockInfo describes a lock about to be taken by this process.
+func newHTTPLockInfo() (httpLockInfo, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return httpLockInfo{}, err
+	}
+	who := CurrentUser()
+	if host, err := os.Hostname(); err == nil {
+		who += "@" + host
+	}
+	return httpLockInfo{ID: hex.EncodeToString(id), Who: who, PID: os.Getpid(), Created: time.Now().UTC()}, nil
+}
+
+// Lock takes the server's lock on the envelope, waiting up to LockTimeout for another
+// holder to release it. Servers that do not lock are left to the envelope's ETag.
+func (hsm HTTPStateManager) Lock() (func() error, error) {
+	info, err := newHTTPLockInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to generate lock ID")
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		resp, err := hsm.do("LOCK", body, header)
+		if err != nil {
+			return nil, err
+		}
+		var holder httpLockInfo
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&holder)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			return func() error { return hsm.unlock(body) }, nil
+		case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			log.Debugf("envelope %s does not support locking, relying on its ETag", hsm)
+			return func() error { return nil }, nil
+		case http.StatusLocked, http.StatusConflict:
+			if !time.Now().Before(deadline) {
+				return nil, &EnvelopeLockedError{Path: hsm.String(), Holder: holder.Who, PID: holder.PID, Timeout: LockTimeout}
+			}
+			time.Sleep(httpLockPollInterval)
+		default:
+			return nil, fmt.Errorf("unexpected status locking envelope %s: %s", hsm, resp.Status)
+		}
+	}
+}
+
+// unlock releases the lock described by body.
+func (hsm HTTPStateManager) unlock(body []byte) error {
+	resp, err := hsm.do("UNLOCK", body, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status unlocking envelope %s: %s", hsm, resp.Status)
+	}
+	return nil
+}
+
+// String returns the envelope URL, without any credentials it carries.
+func (hsm HTTPStateManager) String() string {
+	parsed, err := url.Parse(hsm.url)
+	if err != nil {
+		return hsm.url
+	}
+	return parsed.Redacted()
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// integrityDomain prefixes the data covered by an envelope MAC, so the integrity key can
+// not be used to forge anything else.
+const integrityDomain = "sctl-envelope-mac-v1\n"
+
+// sealedVersion is the first envelope format version always sealed with a MAC, see
+// CurrentVersion.
+const sealedVersion = 4
+
+// ErrIntegrity is returned when an envelope's MAC does not match its contents, as happens
+// when secrets are added, removed or altered by hand, or by a writer unable to reseal it.
+var ErrIntegrity = errors.New("envelope integrity check failed - it was changed outside of sctl, or by a writer unable to reseal it. Review the changes with sctl diff, then reseal it with: sctl verify --reseal")
+
+// ErrUnsealed is returned when an envelope without a MAC is about to be used, as changes
+// made to it outside of sctl can not be detected.
+var ErrUnsealed = errors.New("envelope has no integrity MAC, so changes made to it outside of sctl go undetected. Review it, then seal it with sctl migrate, or use it as it is with --allow-unsealed")
+
+// Integrity is an envelope's MAC, and the integrity key it was computed with. The key is
+// wrapped like a secret's data key: by the envelope's key, named by KeyURI, in DataKey, and
+// by each of its recipient keys in Recipients.
+type Integrity struct {
+	KeyURI     string       `json:"key_uri,omitempty"`
+	DataKey    string       `json:"dek"`
+	Recipients []WrappedKey `json:"recipients,omitempty"`
+	MAC        string       `json:"mac"`
+}
+
+// IntegrityProvider seals envelopes with a MAC as they are saved, and verifies the MAC of
+// envelopes as they are loaded. Wrapping the integrity key needs a KMS, which this package
+// can not reach, so the provider is supplied by the caller through EnvelopeIntegrity.
+type IntegrityProvider interface {
+	// Seal sets the envelope's Integrity from its current contents, reusing its integrity
+	// key while the envelope's keys are unchanged
+	Seal(envelope *V2) error
+	// Verify checks the envelope's Integrity, returning ErrIntegrity on a mismatch
+	Verify(envelope V2) error
+	// Sealable reports whether envelopes under the key URI can be sealed. A MAC proves
+	// nothing under a key anyone may encrypt with, such as an asymmetric key, as anyone
+	// could wrap an integrity key of their own with it.
+	Sealable(keyURI string) bool
+}
+
+// EnvelopeIntegrity seals and verifies envelope MACs. When nil, envelopes are saved with
+// the MAC they were loaded with, and verify without checking it.
+var EnvelopeIntegrity IntegrityProvider
+
+// Sealable returns whether the envelope can be sealed with a MAC, see IntegrityProvider.
+// Envelopes under a key that can not seal them are saved without one.
+func (s V2) Sealable() bool {
+	return EnvelopeIntegrity == nil || s.KeyIdentifier == "" || EnvelopeIntegrity.Sealable(s.KeyIdentifier)
+}
+
+// mustBeSealed returns whether the envelope can only have been written by an sctl that seals
+// envelopes: one of version 4 or later, or with an ID or secrets bound to it.
+func (s V2) mustBeSealed() bool {
+	if version, err := strconv.Atoi(s.Version); err == nil && version >= sealedVersion {
+		return true
+	}
+	if s.ID != "" {
+		return true
+	}
+	for _, secret := range s.Secrets {
+		for _, value := range append([]Secret{secret}, secret.History...) {
+			if value.AAD {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VerifyIntegrity checks the envelope's MAC with EnvelopeIntegrity, returning ErrIntegrity if
+// it does not match. An envelope without a MAC, or under a key that can not seal it, is
+// refused with ErrUnsealed, unless AllowUnsealed trusted it. Unwrapping the integrity key
+// needs one of the envelope's keys, so commands that decrypt the envelope require it, while
+// LoadEnvelope verifies what it can.
+func (s *V2) VerifyIntegrity() error {
+	if err := s.CheckSealed(); err != nil {
+		return err
+	}
+	if s.verified || s.unsealed || s.Integrity == nil || EnvelopeIntegrity == nil {
+		return nil
+	}
+	if err := EnvelopeIntegrity.Verify(*s); err != nil {
+		return errors.Wrapf(err, "unable to verify envelope %s", s.Filepath)
+	}
+	s.verified = true
+	return nil
+}
+
+// CheckSealed returns ErrUnsealed for an envelope loaded without a MAC, or under a key that
+// can not seal it, unless AllowUnsealed trusted it since.
+func (s V2) CheckSealed() error {
+	if s.unsealed && !s.verified {
+		return errors.Wrapf(ErrUnsealed, "refusing to use envelope %s", s.Filepath)
+	}
+	return nil
+}
+
+// AllowUnsealed trusts the contents of an envelope loaded without a MAC, or under a key that
+// can not seal it, so it can be used as it is, and is sealed when saved if its key allows,
+// see Reseal. An envelope with a MAC must still verify.
+func (s *V2) AllowUnsealed() {
+	if s.unsealed {
+		log.Warnf("Envelope %s has no integrity MAC, so changes made to it outside of sctl go undetected", s.Filepath)
+		s.Reseal()
+	}
+}
+
+// Verified returns whether the envelope's MAC was checked, or its contents trusted, since
+// it was loaded.
+func (s V2) Verified() bool {
+	return s.verified
+}
+
+// Reseal trusts the envelope's contents without verifying them, so Save seals them under a
+// new integrity key. It is for contents a holder of the envelope's key has reviewed, such as
+// changes saved by a writer unable to reseal the envelope, or an envelope without a MAC.
+func (s *V2) Reseal() {
+	s.Integrity = nil
+	s.unsealed = false
+	s.verified = true
+}
+
+// verifyOnLoad checks the MAC of an envelope as it is loaded from location. A MAC that does
+// not match is refused. One that can not be checked, as the integrity key can not be
+// unwrapped by whoever loads the envelope, leaves it unverified: it may still be listed, or
+// have secrets added without being resealed, see Save, but not be decrypted.
+func (s *V2) verifyOnLoad(location string) error {
+	if s.unsealed || s.Integrity == nil || EnvelopeIntegrity == nil {
+		return nil
+	}
+	err := EnvelopeIntegrity.Verify(*s)
+	switch {
+	case err == nil:
+		s.verified = true
+	case errors.Is(err, ErrIntegrity):
+		return errors.Wrapf(err, "unable to verify envelope %s", location)
+	default:
+		log.Debugf("Unable to verify envelope %s, so it will not be resealed: %v", location, err)
+	}
+	return nil
+}
+
+// ComputeMAC returns the HMAC-SHA256 of the envelope's contents under key: its key URI,
+// ID, recipients, history depth and every secret, sorted by name, with all of their
+// ciphertexts, history and metadata.
+func (s V2) ComputeMAC(key []byte) (string, error) {
+	secrets := append(Secrets(nil), s.Secrets...)
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	contents, err := json.Marshal(struct {
+		KeyIdentifier string   `json:"key_uri"`
+		ID            string   `json:"id"`
+		Recipients    []string `json:"recipients"`
+		HistoryDepth  *int     `json:"history_depth"`
+		Secrets       Secrets  `json:"secrets"`
+	}{s.KeyIdentifier, s.ID, s.Recipients, s.HistoryDepth, secrets})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode envelope for its MAC")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(integrityDomain))
+	mac.Write(contents)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyMAC checks the envelope's MAC under key, returning ErrIntegrity if it does not
+// match the envelope's contents.
+func (s V2) VerifyMAC(key []byte) error {
+	if s.Integrity == nil {
+		return errors.New("envelope has no integrity MAC")
+	}
+	expected, err := s.ComputeMAC(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(s.Integrity.MAC)) {
+		return ErrIntegrity
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMACEnvelope() V2 {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	envelope := V2{KeyIdentifier: "local:///tmp/test.key", ID: "0123", Recipients: []string{"local:///tmp/backup.key"}}
+	envelope.Secrets.Add(Secret{Name: "A", Cyphertext: "a", DataKey: "ka", Created: created})
+	envelope.Secrets.Add(Secret{Name: "B", Cyphertext: "b", DataKey: "kb", Created: created, Metadata: NewMetadata(created, "jdoe")})
+	return envelope
+}
+
+func TestComputeMAC(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	envelope := testMACEnvelope()
+	mac, err := envelope.ComputeMAC(key)
+	assert.NoError(t, err)
+
+	// The order of secrets, the format version and the MAC itself are not covered
+	reordered := testMACEnvelope()
+	reordered.Secrets[0], reordered.Secrets[1] = reordered.Secrets[1], reordered.Secrets[0]
+	reordered.Version = CurrentVersion
+	reordered.Integrity = &Integrity{DataKey: "wrapped", MAC: "old"}
+	same, err := reordered.ComputeMAC(key)
+	assert.NoError(t, err)
+	assert.Equal(t, mac, same)
+
+	// A different key gives a different MAC
+	other, err := envelope.ComputeMAC([]byte("another key"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, mac, other)
+}
+
+func TestVerifyMAC(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sealed := func() V2 {
+		envelope := testMACEnvelope()
+		mac, err := envelope.ComputeMAC(key)
+		assert.NoError(t, err)
+		envelope.Integrity = &Integrity{DataKey: "wrapped", MAC: mac}
+		return envelope
+	}
+	assert.NoError(t, sealed().VerifyMAC(key))
+	assert.Equal(t, ErrIntegrity, sealed().VerifyMAC([]byte("another key")))
+
+	var testTable = []struct {
+		name   string
+		tamper func(*V2)
+	}{
+		{"Remove secret", func(e *V2) { e.Secrets.Remove("A") }},
+		{"Add secret", func(e *V2) { e.Secrets.Add(Secret{Name: "C", Cyphertext: "c"}) }},
+		{"Swap ciphertexts", func(e *V2) {
+			e.Secrets[0].Cyphertext, e.Secrets[1].Cyphertext = e.Secrets[1].Cyphertext, e.Secrets[0].Cyphertext
+		}},
+		{"Rename secret", func(e *V2) { e.Secrets[0].Name = "Z" }},
+		{"Edit metadata", func(e *V2) { e.Secrets[1].Description = "changed" }},
+		{"Drop recipient", func(e *V2) { e.Recipients = nil }},
+		{"Change key", func(e *V2) { e.KeyIdentifier = "local:///tmp/other.key" }},
+	}
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope := sealed()
+			tt.tamper(&envelope)
+			assert.Equal(t, ErrIntegrity, envelope.VerifyMAC(key))
+		})
+	}
+
+	assert.Error(t, testMACEnvelope().VerifyMAC(key))
+}
+
+// testIntegrity seals envelopes under a fixed integrity key, standing in for the KMS. A
+// locked provider stands in for a writer unable to unwrap the integrity key.
+type testIntegrity struct {
+	key    []byte
+	locked bool
+}
+
+func (p testIntegrity) Seal(envelope *V2) error {
+	if envelope.Integrity == nil {
+		envelope.Integrity = &Integrity{DataKey: "wrapped"}
+	}
+	mac, err := envelope.ComputeMAC(p.key)
+	envelope.Integrity.MAC = mac
+	return err
+}
+
+func (p testIntegrity) Verify(envelope V2) error {
+	if p.locked {
+		return errors.New("permission denied")
+	}
+	return envelope.VerifyMAC(p.key)
+}
+
+// Sealable refuses public:// keys, standing in for asymmetric keys
+func (p testIntegrity) Sealable(keyURI string) bool {
+	return !strings.HasPrefix(keyURI, "public://")
+}
+
+// writeEnvelope writes the envelope to path as it is, without sealing it
+func writeEnvelope(t *testing.T, path string, envelope V2) {
+	data, err := envelope.Canonical()
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestSaveIntegrity(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	previous := EnvelopeIntegrity
+	EnvelopeIntegrity = testIntegrity{key: key}
+	defer func() { EnvelopeIntegrity = previous }()
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	// A new envelope is sealed
+	envelope := testMACEnvelope()
+	envelope.Filepath = path
+	assert.NoError(t, envelope.Save())
+	assert.Equal(t, CurrentVersion, envelope.Version)
+	assert.NotNil(t, envelope.Integrity)
+
+	// Loading verifies the envelope when the integrity key can be unwrapped
+	loaded, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.True(t, loaded.Verified())
+
+	// A writer unable to unwrap it saves a change with the MAC it was loaded with
+	EnvelopeIntegrity = testIntegrity{key: key, locked: true}
+	loaded, err = ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.False(t, loaded.Verified())
+	loaded.Secrets.Add(Secret{Name: "C", Cyphertext: "c"})
+	assert.NoError(t, loaded.Save())
+
+	// Which is refused as it is loaded, but may still be reviewed
+	EnvelopeIntegrity = testIntegrity{key: key}
+	_, err = ReadEnvelope(path)
+	assert.ErrorIs(t, err, ErrIntegrity)
+	assert.ErrorIs(t, UpdateEnvelope(path, func(*V2) error { return nil }), ErrIntegrity)
+	inspected, err := InspectEnvelope(path)
+	assert.NoError(t, err)
+	assert.Len(t, inspected.Secrets, 3)
+	assert.ErrorIs(t, inspected.VerifyIntegrity(), ErrIntegrity)
+
+	// Until the change is reviewed and resealed
+	assert.NoError(t, ResealEnvelope(path, func(V2) error { return nil }))
+	resealed, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.NoError(t, resealed.VerifyIntegrity())
+	assert.True(t, resealed.Verified())
+
+	// A verified envelope is resealed as it is saved
+	assert.NoError(t, UpdateEnvelope(path, func(envelope *V2) error {
+		assert.True(t, envelope.Verified())
+		envelope.Secrets.Remove("C")
+		return nil
+	}))
+	updated, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.NoError(t, updated.VerifyIntegrity())
+	assert.Len(t, updated.Secrets, 2)
+
+	// A sealed envelope whose MAC was removed is refused, even claiming to predate MACs, as
+	// only an sctl that seals envelopes gives them an ID
+	updated.Integrity = nil
+	writeEnvelope(t, path, updated)
+	_, err = ReadEnvelope(path)
+	assert.ErrorIs(t, err, ErrIntegrity)
+	updated.Version = "3"
+	writeEnvelope(t, path, updated)
+	_, err = ReadEnvelope(path)
+	assert.ErrorIs(t, err, ErrIntegrity)
+	_, err = InspectEnvelope(path)
+	assert.ErrorIs(t, err, ErrIntegrity)
+
+	// As does binding its secrets to it
+	bound := updated
+	bound.ID = ""
+	bound.Secrets = Secrets{Secret{Name: "A", Cyphertext: "a", AAD: true}}
+	writeEnvelope(t, path, bound)
+	_, err = ReadEnvelope(path)
+	assert.ErrorIs(t, err, ErrIntegrity)
+
+	// An envelope from before MACs loads, but is refused until trusted
+	updated.ID = ""
+	writeEnvelope(t, path, updated)
+	unsealed, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, unsealed.VerifyIntegrity(), ErrUnsealed)
+	assert.ErrorIs(t, unsealed.CheckSealed(), ErrUnsealed)
+
+	// It is saved without a MAC while it would still load, but not once given an ID
+	assert.NoError(t, DeleteSecret("B", path))
+	assert.ErrorIs(t, UpdateEnvelope(path, func(*V2) error { return nil }), ErrUnsealed)
+	unsealed, err = ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.Nil(t, unsealed.Integrity)
+	assert.Equal(t, "3", unsealed.Version)
+	assert.Len(t, unsealed.Secrets, 1)
+
+	// Once trusted, it is used as it is and sealed as it is saved
+	unsealed.AllowUnsealed()
+	assert.NoError(t, unsealed.VerifyIntegrity())
+	assert.NoError(t, unsealed.Save())
+	assert.NotNil(t, unsealed.Integrity)
+	sealed, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.True(t, sealed.Verified())
+}
+
+func TestSaveIntegrityPublicKey(t *testing.T) {
+	previous := EnvelopeIntegrity
+	EnvelopeIntegrity = testIntegrity{key: []byte("0123456789abcdef0123456789abcdef")}
+	defer func() { EnvelopeIntegrity = previous }()
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	// An envelope under a key anyone may encrypt with is saved without a MAC
+	envelope := testMACEnvelope()
+	envelope.KeyIdentifier = "public://key"
+	envelope.Integrity = &Integrity{DataKey: "wrapped", MAC: "forged"}
+	envelope.Filepath = path
+	assert.False(t, envelope.Sealable())
+	assert.NoError(t, envelope.Save())
+	assert.Nil(t, envelope.Integrity)
+
+	// So it loads despite its ID, but is refused until trusted
+	loaded, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, loaded.VerifyIntegrity(), ErrUnsealed)
+	loaded.AllowUnsealed()
+	assert.NoError(t, loaded.VerifyIntegrity())
+	assert.NoError(t, loaded.Save())
+	assert.Nil(t, loaded.Integrity)
+}
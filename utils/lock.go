@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LockSuffix is appended to an envelope's path to name the sidecar file locked while the
+// envelope is modified, eg: .scuttle.json.lock
+const LockSuffix = ".lock"
+
+// LockTimeout is how long to wait for another sctl process to release an envelope before
+// giving up. A zero timeout gives up immediately.
+var LockTimeout = 30 * time.Second
+
+// lockPollInterval is how often a held lock is retried while waiting for it.
+var lockPollInterval = 50 * time.Millisecond
+
+// EnvelopeLockedError is returned when an envelope stays locked by another process for longer
+// than LockTimeout. Holder names who holds a remote lock, eg: jdoe@ci-runner-3
+type EnvelopeLockedError struct {
+	Path    string
+	Holder  string
+	PID     int
+	Timeout time.Duration
+}
+
+func (e *EnvelopeLockedError) Error() string {
+	holder := "another sctl process"
+	if e.Holder != "" {
+		holder = e.Holder
+	}
+	if e.PID > 0 {
+		holder = fmt.Sprintf("%s (pid %d)", holder, e.PID)
+	}
+	return fmt.Sprintf("envelope %s is locked by %s - gave up waiting after %s", e.Path, holder, e.Timeout)
+}
+
+// envelopeLock is an advisory lock on an envelope, held across load-modify-save so
+// concurrent writers do not drop each other's changes.
+type envelopeLock struct {
+	file *os.File
+}
+
+// lockEnvelope takes the advisory lock on the envelope at path, waiting up to LockTimeout
+// for another holder to release it. The holder's PID is recorded in the lock file, so
+// anyone left waiting can be told who has it.
+func lockEnvelope(path string) (*envelopeLock, error) {
+	lockPath := path + LockSuffix
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open envelope lock")
+	}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "unable to lock %s", lockPath)
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, &EnvelopeLockedError{Path: path, PID: lockHolder(lockPath), Timeout: LockTimeout}
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Record ourselves as the holder. This is informational, so failure is not fatal.
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &envelopeLock{file: file}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place, as removing it would race
+// with processes waiting to lock it.
+func (l *envelopeLock) Unlock() error {
+	unlockErr := unlockFile(l.file)
+	closeErr := l.file.Close()
+	if unlockErr != nil {
+		return unlockErr
+	}
+	return closeErr
+}
+
+// lockHolder reads the PID recorded in a lock file, or 0 if none can be read.
+func lockHolder(lockPath string) int {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// withEnvelopeLock runs fn while holding the lock on the envelope at path, for backends
+// that lock.
+func withEnvelopeLock(path string, fn func() error) error {
+	manager, err := NewEnvelopeStateManager(path)
+	if err != nil {
+		return err
+	}
+	unlock, err := manager.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockEnvelope(t *testing.T) {
+	defer func(timeout time.Duration) { LockTimeout = timeout }(LockTimeout)
+	LockTimeout = 100 * time.Millisecond
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	lock, err := lockEnvelope(path)
+	assert.NoError(t, err)
+
+	// A second writer gives up, naming the holder
+	_, err = lockEnvelope(path)
+	var locked *EnvelopeLockedError
+	assert.True(t, errors.As(err, &locked))
+	assert.Equal(t, os.Getpid(), locked.PID)
+	assert.EqualError(t, err, fmt.Sprintf("envelope %s is locked by another sctl process (pid %d) - gave up waiting after 100ms", path, os.Getpid()))
+
+	// Writers waiting on the lock get it once it is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lock.Unlock()
+	}()
+	second, err := lockEnvelope(path)
+	assert.NoError(t, err)
+	assert.NoError(t, second.Unlock())
+}
+
+// Concurrent writers each keep their secret.
+func TestAddSecretConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := AddSecret(Secret{Name: fmt.Sprintf("SECRET_%d", i)}, "local:///test.key", true, path)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	envelope, err := ReadEnvelope(path)
+	assert.NoError(t, err)
+	assert.Len(t, envelope.Secrets, 20)
+}
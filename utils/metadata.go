@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetadataKeys are the metadata fields that may be edited with SetMetadata. The remaining
+// fields are maintained by sctl.
+var MetadataKeys = []string{"description", "tags", "expires", "rotation_period"}
+
+// Metadata describes a secret, without being part of its sealed value. It was introduced
+// with version 3 envelopes, is carried over when a secret is rotated or re-keyed, and all
+// of it is optional.
+//
+// Updated is when the secret's value last changed, and CreatedBy the user that first added
+// it. Expires and RotationPeriod record when the secret is due to be replaced, with the
+// rotation period in the form accepted by ParseRotationPeriod, eg: 90d
+type Metadata struct {
+	Updated        *time.Time `json:"updated,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	Description    string     `json:"description,omitempty"`
+	Tags           []string   `json:"tags,omitempty"`
+	Expires        *time.Time `json:"expires,omitempty"`
+	RotationPeriod string     `json:"rotation_period,omitempty"`
+}
+
+// IsZero reports whether no metadata has been recorded.
+func (m Metadata) IsZero() bool {
+	return m.Updated == nil && m.CreatedBy == "" && m.Description == "" && len(m.Tags) == 0 &&
+		m.Expires == nil && m.RotationPeriod == ""
+}
+
+// NewMetadata returns the metadata of a secret first added at created by the named user.
+func NewMetadata(created time.Time, createdBy string) Metadata {
+	return Metadata{
+		Updated:   &created,
+		CreatedBy: createdBy,
+	}
+}
+
+// SetMetadata sets one of the MetadataKeys from its string form. An empty value clears the
+// field.
+func (m *Metadata) SetMetadata(key string, value string) error {
+	switch key {
+	case "description":
+		m.Description = value
+	case "tags":
+		m.Tags = parseTags(value)
+	case "expires":
+		if value == "" {
+			m.Expires = nil
+			return nil
+		}
+		expires, err := parseTime(value)
+		if err != nil {
+			return fmt.Errorf("invalid expires %q - use a date (2006-01-02) or RFC 3339 time", value)
+		}
+		m.Expires = &expires
+	case "rotation_period":
+		if value != "" {
+			if _, err := ParseRotationPeriod(value); err != nil {
+				return err
+			}
+		}
+		m.RotationPeriod = value
+	default:
+		return fmt.Errorf("unknown metadata key %q - expected one of %s", key, strings.Join(MetadataKeys, ", "))
+	}
+	return nil
+}
+
+// MetadataEntries returns the recorded metadata as key=value strings, in a stable order.
+func (m Metadata) MetadataEntries() []string {
+	var entries []string
+	add := func(key string, value string) {
+		if value != "" {
+			entries = append(entries, key+"="+value)
+		}
+	}
+	if m.Updated != nil {
+		add("updated", m.Updated.Format(time.RFC3339))
+	}
+	add("created_by", m.CreatedBy)
+	add("description", m.Description)
+	add("tags", strings.Join(m.Tags, ","))
+	if m.Expires != nil {
+		add("expires", m.Expires.Format(time.RFC3339))
+	}
+	add("rotation_period", m.RotationPeriod)
+	return entries
+}
+
+// ParseRotationPeriod parses a rotation period, given either as a whole number of days with
+// a "d" suffix (eg: 90d), or as a Go duration (eg: 720h).
+func ParseRotationPeriod(period string) (time.Duration, error) {
+	if strings.HasSuffix(period, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(period, "d"))
+		if err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if duration, err := time.ParseDuration(period); err == nil && duration > 0 {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("invalid rotation_period %q - use days (90d) or a duration (720h)", period)
+}
+
+// CurrentUser names the user running sctl, for recording who added a secret.
+func CurrentUser() string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username
+	}
+	for _, name := range []string{"USER", "USERNAME"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return "unknown"
+}
+
+// parseTags splits a comma separated list of tags, dropping blanks and duplicates.
+func parseTags(value string) []string {
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// parseTime parses a date or an RFC 3339 time.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMetadata(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		key      string
+		value    string
+		expected Metadata
+		err      bool
+	}{
+		{"Description", "description", "API token", Metadata{Description: "API token"}, false},
+		{"Tags", "tags", "db, api,,db", Metadata{Tags: []string{"api", "db"}}, false},
+		{"Clear Tags", "tags", "", Metadata{}, false},
+		{"Expires Date", "expires", "2030-01-02", Metadata{Expires: timePtr(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC))}, false},
+		{"Expires Time", "expires", "2030-01-02T03:04:05Z", Metadata{Expires: timePtr(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))}, false},
+		{"Bad Expires", "expires", "next week", Metadata{}, true},
+		{"Rotation Days", "rotation_period", "90d", Metadata{RotationPeriod: "90d"}, false},
+		{"Rotation Duration", "rotation_period", "720h", Metadata{RotationPeriod: "720h"}, false},
+		{"Bad Rotation", "rotation_period", "quarterly", Metadata{}, true},
+		{"Unknown Key", "created_by", "someone", Metadata{}, true},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			var metadata Metadata
+			err := metadata.SetMetadata(tt.key, tt.value)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, metadata)
+		})
+	}
+}
+
+func TestParseRotationPeriod(t *testing.T) {
+	period, err := ParseRotationPeriod("90d")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*24*time.Hour, period)
+
+	period, err = ParseRotationPeriod("36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, period)
+
+	for _, bad := range []string{"", "0d", "-1h", "d", "1w"} {
+		_, err = ParseRotationPeriod(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// A rotated secret keeps its creation time and metadata.
+func TestSecretReplacing(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous := Secret{Name: "A", Cyphertext: "old", Created: created, Metadata: NewMetadata(created, "jdoe")}
+	previous.Description = "the first"
+	rotated := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	replaced := Secret{Name: "A", Cyphertext: "new", Created: rotated}.Replacing(previous, DefaultHistoryDepth)
+	assert.Equal(t, "new", replaced.Cyphertext)
+	assert.Equal(t, created, replaced.Created)
+	assert.Equal(t, rotated, *replaced.Updated)
+	assert.Equal(t, "jdoe", replaced.CreatedBy)
+	assert.Equal(t, "the first", replaced.Description)
+	// The previous secret is left alone
+	assert.Equal(t, created, *previous.Updated)
+}
+
+// Metadata is stored alongside the other secret fields, and only when present.
+func TestMetadataJSON(t *testing.T) {
+	data, err := json.Marshal(Secret{Name: "A"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "updated")
+
+	secret := Secret{Name: "A", Metadata: Metadata{Description: "an API token", Tags: []string{"api"}}}
+	data, err = json.Marshal(secret)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"description":"an API token","tags":["api"]`)
+
+	var decoded Secret
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, secret, decoded)
+}
+
+func TestGetVersion(t *testing.T) {
+	depth := 1
+	var testTable = []struct {
+		name     string
+		envelope V2
+		expected string
+	}{
+		{"Plain", V2{Secrets: Secrets{{Name: "A"}}}, "2"},
+		{"Recipients", V2{Recipients: []string{"local:///recovery.key"}}, "3"},
+		{"Metadata", V2{Secrets: Secrets{{Name: "A", Metadata: Metadata{Description: "a"}}}}, "3"},
+		{"History Depth", V2{HistoryDepth: &depth}, "3"},
+		{"History", V2{Secrets: Secrets{{Name: "A", Version: 2}}}, "3"},
+		{"Migrated", V2{Version: "3"}, "3"},
+		{"Migrated Unsealed", V2{Version: "4"}, "3"},
+		{"Sealed", V2{Integrity: &Integrity{}}, "4"},
+	}
+
+	for _, tt := range testTable {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.envelope.GetVersion())
+		})
+	}
+}
+
+// Envelopes from a newer sctl are refused rather than risk losing what they hold.
+func TestVersionedLoaderNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".scuttle.json")
+	err := os.WriteFile(path, []byte(`{"key_uri": "local:///test.key", "version": "5", "secrets": []}`), 0600)
+	assert.NoError(t, err)
+
+	_, err = NewVersionedLoader(path).ReadState()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than this sctl supports")
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -1,11 +1,14 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,14 +19,69 @@ import (
 //	{
 //	  "name": "A_SECRET",
 //	  "cypher": "0xD34DB33F",
+//	  "dek": "0xB4DC0FF33",
+//	  "key_version": "projects/sctl/locations/us/keyRings/sctl/cryptoKeys/sctl-dev/cryptoKeyVersions/1",
+//	  "aad": true,
+//	  "recipients": [{"key_uri": "vault://transit/break-glass", "dek": "0xF00DF4C3"}],
 //	  "created": "2019-05-01 13:01:27.189242799 -0500 CDT m=+0.000075907",
-//	  "encoding": "plain"
+//	  "encoding": "plain",
+//	  "updated": "2019-06-01T09:30:00Z",
+//	  "created_by": "jdoe",
+//	  "description": "Database password for the API",
+//	  "tags": ["api", "database"],
+//	  "expires": "2020-05-01T00:00:00Z",
+//	  "rotation_period": "90d"
 //	 }
+//
+// When DataKey is present, Cyphertext was sealed locally with a data encryption key,
+// and DataKey holds that key wrapped by the envelope's KMS key. Secrets without a
+// DataKey were encrypted directly by the KMS.
+//
+// KeyVersion names the version of the envelope's key that wrapped DataKey, for keys that
+// are versioned. Secrets on a version other than the key's primary version are stale, and
+// are brought up to date by a rekey.
+//
+// Recipients holds the same data key wrapped by each of the envelope's recipient keys, any
+// of which can be used to decrypt the secret when the envelope's key is unavailable.
+//
+// When AAD is set, Cyphertext was sealed with the secret's name and the envelope's ID
+// as additional authenticated data, and will only decrypt under that name in that
+// envelope.
+//
+// Version numbers the secret's value, which is replaced by adding the secret again. The
+// values it replaced are kept newest first in History, up to the envelope's history
+// depth, each with the version it was and the time it was set as Created.
+//
+// The remaining fields are the secret's optional Metadata.
 type Secret struct {
-	Name       string    `json:"name"`
-	Cyphertext string    `json:"cypher"`
-	Created    time.Time `json:"created"`
-	Encoding   string    `json:"encoding"`
+	Name       string       `json:"name"`
+	Cyphertext string       `json:"cypher"`
+	DataKey    string       `json:"dek,omitempty"`
+	KeyVersion string       `json:"key_version,omitempty"`
+	AAD        bool         `json:"aad,omitempty"`
+	Recipients []WrappedKey `json:"recipients,omitempty"`
+	Created    time.Time    `json:"created"`
+	Encoding   string       `json:"encoding"`
+	Version    int          `json:"version,omitempty"`
+	History    []Secret     `json:"history,omitempty"`
+	Metadata
+}
+
+// WrappedKey is a secret's data key wrapped by one of the envelope's recipient keys.
+type WrappedKey struct {
+	KeyURI  string `json:"key_uri"`
+	DataKey string `json:"dek"`
+}
+
+// WrappedKey returns the data key wrapped by the named recipient key, or an empty string
+// if the secret was not sealed for that recipient.
+func (s Secret) WrappedKey(keyURI string) string {
+	for _, wrapped := range s.Recipients {
+		if wrapped.KeyURI == keyURI {
+			return wrapped.DataKey
+		}
+	}
+	return ""
 }
 
 // Secrets - A collection of Secret
@@ -42,11 +100,12 @@ func (s *Secrets) Remove(name string) {
 // Add - Upsert a secret into the collection. If a key exists,
 // it will presume rotation, and update in-place.
 func (s *Secrets) Add(toAdd Secret) {
-	// Adds or Updates a secret
+	// Adds or Updates a secret, keeping a rotated secret in its place
 	for index, element := range *s {
 		if element.Name == toAdd.Name {
 			log.Printf("Rotating entry %s", element.Name)
-			*s = append((*s)[:index], (*s)[index+1:]...)
+			(*s)[index] = toAdd
+			return
 		}
 	}
 	*s = append(*s, toAdd)
@@ -63,16 +122,44 @@ func (s *Secrets) Find(secretName string) (Secret, error) {
 	return Secret{}, fmt.Errorf("Secret %s not found", secretName)
 }
 
+// CurrentVersion is the newest envelope format version sctl reads and writes. Version 4
+// envelopes are sealed with an integrity MAC, which they must always carry.
+const CurrentVersion = "4"
+
 // V2 Secrets is a representation of the envelope enhanced to track their
 // own key URI.
 // This secret wrapper will validate that an incoming request to encrypt
 // matches the same key declared on the state file before performing IO.
 // otherwise it raises an error.
+// Recipients lists additional key URIs that every secret's data key is also wrapped by,
+// so the envelope can be recovered should its own key be lost. Envelopes with recipients
+// or secret metadata and history are written as version 3, as are envelopes migrated to it.
+// HistoryDepth is the number of previous values kept for each secret, or when unset,
+// DefaultHistoryDepth.
+// Integrity holds a MAC over the rest of the envelope, so tampering with its secrets is
+// detected, see VerifyIntegrity. Envelopes with one are written as version 4.
+// The ID is a random identifier assigned to the envelope when it is first written, and
+// is used to bind secrets to the envelope they were added to.
+// Filepath locates the envelope, as a path or the URL of a remote backend, see
+// NewEnvelopeStateManager.
 type V2 struct {
-	KeyIdentifier string `json:"key_uri"`
-	Version       string `json:"version"`
-	Filepath      string `json:"-"`
+	KeyIdentifier string     `json:"key_uri"`
+	Version       string     `json:"version"`
+	ID            string     `json:"id,omitempty"`
+	Recipients    []string   `json:"recipients,omitempty"`
+	HistoryDepth  *int       `json:"history_depth,omitempty"`
+	Integrity     *Integrity `json:"integrity,omitempty"`
+	Filepath      string     `json:"-"`
 	Secrets       `json:"secrets"`
+
+	// revision is the backend revision the envelope was loaded at, see EnvelopeStateManager
+	revision string
+	// unsealed is set on an existing envelope loaded without a MAC, which Save only seals
+	// once its contents are trusted, see Reseal
+	unsealed bool
+	// verified is set once the envelope's MAC is checked, or its contents trusted, so Save
+	// may reseal it
+	verified bool
 }
 
 // SameKey compares the KeyURI for the incoming encrypt/decrypt request.
@@ -100,8 +187,34 @@ func (s *V2) SameKey(key string) bool {
 	return s.KeyIdentifier == key
 }
 
-// GetVersion returns the statically declared version for the type of SecretsV2 - "2"
+// EnsureID assigns a new random ID to the envelope if it does not already have one.
+func (s *V2) EnsureID() error {
+	if s.ID != "" {
+		return nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	s.ID = hex.EncodeToString(id)
+	return nil
+}
+
+// GetVersion returns the format version the envelope is written as - "2", "3" once the
+// envelope uses recipients, secret metadata or history, or was migrated to version 3, and
+// "4" once it is sealed with an integrity MAC.
 func (s V2) GetVersion() string {
+	if s.Integrity != nil {
+		return CurrentVersion
+	}
+	if s.Version == "3" || s.Version == CurrentVersion || len(s.Recipients) > 0 || s.HistoryDepth != nil {
+		return "3"
+	}
+	for _, secret := range s.Secrets {
+		if !secret.Metadata.IsZero() || secret.Version != 0 {
+			return "3"
+		}
+	}
 	return "2"
 }
 
@@ -124,19 +237,50 @@ func (s *V2) Load() error {
 	return json.Unmarshal([]byte(file), s)
 }
 
-// Save will attempt to serialize the entirety of the V2 object to a statefile on disk indicated by the
-// Filepath parameter on the V2 object.
+// Save will attempt to serialize the entirety of the V2 object to the envelope's backend, located by
+// the Filepath parameter on the V2 object. Statefiles on disk are replaced atomically, keeping their
+// previous version as a backup. Envelopes in remote backends are only replaced if unchanged since they
+// were loaded. The envelope is written in its canonical form, see Canonical.
+//
+// When EnvelopeIntegrity is set, the envelope is sealed with a MAC if it is new, its MAC was
+// verified or its contents trusted, see VerifyIntegrity and Reseal. Otherwise the contents
+// are saved as they are, keeping any MAC they had, for a holder of the envelope's key to
+// review and reseal. An envelope under a key that can not seal it is saved without a MAC,
+// and one without a MAC is only saved without one if it would still load, see ErrUnsealed.
 func (s *V2) Save() error {
-	if s.Version == "" {
-		s.Version = "2"
-	}
-	if len(s.KeyIdentifier) == 0 {
+	switch {
+	case len(s.KeyIdentifier) == 0:
 		log.Warn("No KeyURI provided to scuttles envelope. Saving without KeyIdentifier embedded.")
+	case EnvelopeIntegrity == nil:
+	case !s.Sealable():
+		s.Integrity = nil
+		log.Warnf("Envelope %s is saved without an integrity MAC, as anyone able to encrypt with its key %s could forge one", s.Filepath, s.KeyIdentifier)
+	case s.Integrity == nil && s.unsealed && !s.verified:
+		if s.mustBeSealed() {
+			return errors.Wrapf(ErrUnsealed, "refusing to save envelope %s", s.Filepath)
+		}
+		log.Warnf("Envelope %s has no integrity MAC, so it is saved without one. Review it, then add one with: sctl migrate", s.Filepath)
+	case s.Integrity != nil && !s.verified:
+		log.Warnf("Envelope %s could not be verified, so its MAC no longer matches. A holder of its key must review it with sctl diff, then reseal it with: sctl verify --reseal", s.Filepath)
+	default:
+		if err := EnvelopeIntegrity.Seal(s); err != nil {
+			return errors.Wrap(err, "unable to seal envelope integrity")
+		}
+		s.verified = true
+	}
+	s.Version = s.GetVersion()
+	jsonData, err := s.Canonical()
+	if err != nil {
+		return err
+	}
+	manager, err := NewEnvelopeStateManager(s.Filepath)
+	if err != nil {
+		return err
 	}
-	jsonData, err := json.MarshalIndent(s, "", " ")
+	revision, err := manager.WriteEnvelope(jsonData, s.revision)
 	if err != nil {
 		return err
 	}
-	mode := int(0660) // file mode
-	return os.WriteFile(s.Filepath, jsonData, os.FileMode(mode))
+	s.revision = revision
+	return nil
 }
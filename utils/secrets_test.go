@@ -87,8 +87,20 @@ func TestV2SameKeySameKeys(t *testing.T) {
 	assert.True(t, expectTrue)
 }
 
-// This test is largely useless. The GetVersion method returns a static "2" string.
-// So we'll just make sure we get 2 from V2 so we dont accidentally break it.
+func TestV2EnsureID(t *testing.T) {
+	s := V2{}
+	err := s.EnsureID()
+	assert.NoError(t, err)
+	assert.Len(t, s.ID, 32)
+
+	// An existing ID is never replaced
+	id := s.ID
+	err = s.EnsureID()
+	assert.NoError(t, err)
+	assert.Equal(t, id, s.ID)
+}
+
+// A new envelope is written as version 2. The later versions are covered by TestGetVersion.
 func TestV2GetVersion(t *testing.T) {
 	s := V2{}
 	assert.Equal(t, "2", s.GetVersion())
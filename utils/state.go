@@ -2,8 +2,11 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strconv"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -12,8 +15,8 @@ import (
 const defaultFile = ".scuttle.json"
 
 // StateManager is An interface to use when designing state storage routines.
-// at the time of writing this is only filesystem files, but could be extended
-// to support remote backends like vault, cloud-memory-store, et-al.
+// It stores V1 envelopes, which are only ever filesystem files. V2 envelopes
+// may also be stored in remote backends, see EnvelopeStateManager.
 type StateManager interface {
 	ReadState() (Secrets, error)
 	WriteState(Secrets) error
@@ -41,14 +44,14 @@ func (ism IOStateManager) ReadState() (Secrets, error) {
 	return data, err
 }
 
-// WriteState will Serialize secret data state to JSON on disk.
+// WriteState will Serialize secret data state to JSON on disk, replacing the file atomically.
 func (ism IOStateManager) WriteState(data Secrets) error {
 	jsonData, err := json.MarshalIndent(&data, "", " ")
 	if err != nil {
 		return err
 	}
 	log.Debug(string(jsonData))
-	return os.WriteFile(ism.filename, jsonData, os.FileMode(0660))
+	return WriteFileAtomic(ism.filename, jsonData, os.FileMode(0660))
 }
 
 // NewIOStateManager is a factory method to initialize an IOStateManager.
@@ -64,27 +67,42 @@ type VersionedLoader struct {
 	Filepath string
 }
 
-// ReadState Attempts to deserialize a V2 secret envelope. If it encounters an error unmarshalling
+// ReadState Attempts to deserialize a V2 or V3 secret envelope. If it encounters an error unmarshalling
 // the data structure, it will fall back and attempt to initialize a new V2 secret envelope, and populate
 // with what we presume to be a V1 format. If that fails, we fail fatally.
+// Envelopes written by a newer sctl than this one are refused, rather than risk dropping
+// what they contain when saved.
 func (vl VersionedLoader) ReadState() (V2, error) {
 	data, err := os.ReadFile(vl.Filepath)
 	if err != nil {
 		return V2{}, err
 	}
+	return parseEnvelope(data, vl.Filepath)
+}
+
+// parseEnvelope deserializes an envelope read from location, as VersionedLoader.ReadState
+// describes.
+func parseEnvelope(data []byte, location string) (V2, error) {
 	var envelope V2
-	err = json.Unmarshal(data, &envelope)
+	err := json.Unmarshal(data, &envelope)
 	if err != nil {
 		// Try loading from V1 into this struct as a fallback case
 		log.Debug("Falling back to V1 parser")
-		ism := NewIOStateManager(vl.Filepath)
-		finalAttempt, werr := ism.ReadState()
-		if werr != nil {
+		var finalAttempt Secrets
+		if werr := json.Unmarshal(data, &finalAttempt); werr != nil {
 			return V2{}, werr
 		}
 		envelope.Secrets = finalAttempt
 		return envelope, nil
 	}
+	supported, _ := strconv.Atoi(CurrentVersion)
+	version, err := strconv.Atoi(envelope.Version)
+	if err == nil && version > supported {
+		return V2{}, fmt.Errorf("envelope %s is version %d, which is newer than this sctl supports (%s) - please upgrade sctl", location, version, CurrentVersion)
+	}
+	if EnvelopeIntegrity != nil && envelope.Integrity == nil && envelope.mustBeSealed() && envelope.Sealable() {
+		return V2{}, errors.Wrapf(ErrIntegrity, "envelope %s was sealed, but its integrity MAC was removed", location)
+	}
 	return envelope, nil
 }
 
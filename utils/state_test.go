@@ -3,6 +3,7 @@
 package utils
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -42,7 +43,7 @@ func TestStateManagementReader(t *testing.T) {
 }
 
 func TestStateManagementWriter(t *testing.T) {
-	iosm := NewIOStateManager("../testdata/test_writer_temp.json")
+	iosm := NewIOStateManager(filepath.Join(t.TempDir(), "test_writer_temp.json"))
 
 	err := iosm.WriteState([]Secret{
 		{Name: "TEST", Cyphertext: "ABC123", Created: time.Now()},
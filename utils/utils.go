@@ -55,8 +55,16 @@ func eofKeySequenceText() string {
 	return "Enter and Ctrl+D"
 }
 
-// AddSecret Recalls state if present, and appends a secret to the state file
+// AddSecret Recalls state if present, and appends a secret to the state file. The envelope is
+// locked while it is updated.
 func AddSecret(toAdd Secret, keyURI string, keyCheck bool, envelope string) error {
+	return withEnvelopeLock(envelope, func() error {
+		return addSecret(toAdd, keyURI, keyCheck, envelope)
+	})
+}
+
+// addSecret is AddSecret, with the envelope already locked
+func addSecret(toAdd Secret, keyURI string, keyCheck bool, envelope string) error {
 	stateFile := V2{Filepath: envelope}
 	stateFile.KeyIdentifier = keyURI
 
@@ -72,6 +80,7 @@ func AddSecret(toAdd Secret, keyURI string, keyCheck bool, envelope string) erro
 			return errors.Wrap(err, "failed parsing all known envelope formats")
 		}
 	}
+	contents.Filepath = envelope
 
 	// keyCheck overrides if we bother with the key evaluation. This is problematic
 	// when doing re-key operations on a post-v2 migrated envelope.
@@ -90,8 +99,19 @@ func AddSecret(toAdd Secret, keyURI string, keyCheck bool, envelope string) erro
 		return errors.Wrap(err, "unable to marshall secret envelope for storage on disk")
 	}
 	log.Debugf("Saving secret envelope with: %v", string(jsonData))
+	stateFile.ID = contents.ID
+	stateFile.Version = contents.Version
+	stateFile.Recipients = contents.Recipients
+	stateFile.HistoryDepth = contents.HistoryDepth
 	stateFile.Secrets = contents.Secrets
+	stateFile.revision = contents.revision
+	stateFile.Integrity = contents.Integrity
+	stateFile.unsealed = contents.unsealed
+	stateFile.verified = contents.verified
 
+	if previous, err := stateFile.Secrets.Find(toAdd.Name); err == nil {
+		toAdd = toAdd.Replacing(previous, stateFile.GetHistoryDepth())
+	}
 	stateFile.Secrets.Add(toAdd)
 	return stateFile.Save()
 }
@@ -111,31 +131,129 @@ func ReadSecrets(envelope string) (Secrets, string, error) {
 	return contents.Secrets, contents.KeyIdentifier, nil
 }
 
-// DeleteSecret is a Wrapper to remove a secret from state
-// toRemove - string - named key of the secret to eject from the state storage
-func DeleteSecret(toRemove string, envelope string) error {
+// ReadEnvelope is a Wrapper to return the whole envelope for processing. A missing
+// envelope is masked and returned empty, to account for first-run.
+func ReadEnvelope(envelope string) (V2, error) {
 	contents, err := LoadEnvelope(envelope)
 	if err != nil {
-		return errors.Wrap(err, "failed parsing all known envelope formats - refusing to remove secret")
+		if os.IsNotExist(err) {
+			return V2{Filepath: envelope}, nil
+		}
+		if errors.Is(err, ErrIntegrity) {
+			return V2{}, err
+		}
+		return V2{}, errors.Wrap(err, "failed parsing all known envelope formats")
 	}
-
-	contents.Secrets.Remove(toRemove)
 	contents.Filepath = envelope
-	return contents.Save()
+	return contents, nil
+}
+
+// UpdateEnvelope recalls state if present, hands it to update for modification, and
+// saves the result. The envelope is assigned an ID before update is called. Nothing is
+// saved if update returns an error. The envelope is locked throughout.
+func UpdateEnvelope(envelope string, update func(*V2) error) error {
+	return withEnvelopeLock(envelope, func() error {
+		contents, err := ReadEnvelope(envelope)
+		if err != nil {
+			return err
+		}
+		if err := contents.EnsureID(); err != nil {
+			return errors.Wrap(err, "unable to generate envelope ID")
+		}
+		if err := update(&contents); err != nil {
+			return err
+		}
+		return contents.Save()
+	})
+}
+
+// DeleteSecret is a Wrapper to remove a secret from state
+// toRemove - string - named key of the secret to eject from the state storage
+// The envelope is locked while it is updated.
+func DeleteSecret(toRemove string, envelope string) error {
+	return withEnvelopeLock(envelope, func() error {
+		contents, err := LoadEnvelope(envelope)
+		if err != nil {
+			return errors.Wrap(err, "failed parsing all known envelope formats - refusing to remove secret")
+		}
+		contents.Filepath = envelope
+
+		contents.Secrets.Remove(toRemove)
+		return contents.Save()
+	})
+}
+
+// ResealEnvelope seals the envelope with a new MAC over its current contents, whether or not
+// its MAC verifies, once review accepts them. It is for a holder of the envelope's key who
+// has reviewed changes saved without resealing, see Reseal. The envelope is locked
+// throughout.
+func ResealEnvelope(envelope string, review func(V2) error) error {
+	return withEnvelopeLock(envelope, func() error {
+		contents, err := InspectEnvelope(envelope)
+		if err != nil {
+			return err
+		}
+		contents.Filepath = envelope
+		if err := review(contents); err != nil {
+			return err
+		}
+		contents.Reseal()
+		return contents.Save()
+	})
 }
 
 // LoadEnvelope loads the scuttle envelope JSON into a V2 config struct.
 //
-// The `path` parameter may be either the path to the envelope file (e.g. .scuttle.json)
-// or it may be the path to a directory containing the envelope file.
+// The `path` parameter may be either the path to the envelope file (e.g. .scuttle.json),
+// the path to a directory containing the envelope file, or the URL of an envelope in a
+// remote backend (e.g. gs://bucket/.scuttle.json).
+//
+// The envelope's MAC is verified when its integrity key can be unwrapped, and an envelope
+// that does not match it is refused with ErrIntegrity. One that could not be verified is
+// still loaded, so commands that decrypt it must call VerifyIntegrity too.
 func LoadEnvelope(path string) (V2, error) {
-	envelope, err := getEnvelopePath(path)
+	return loadEnvelope(path, true)
+}
+
+// InspectEnvelope loads the envelope like LoadEnvelope, without verifying its MAC, so an
+// envelope that does not match it can still be reviewed.
+func InspectEnvelope(path string) (V2, error) {
+	return loadEnvelope(path, false)
+}
+
+// loadEnvelope is LoadEnvelope, verifying the envelope's MAC only when verify is set
+func loadEnvelope(path string, verify bool) (V2, error) {
+	manager, err := NewEnvelopeStateManager(path)
 	if err != nil {
 		return V2{}, err
 	}
+	data, revision, err := manager.ReadEnvelope()
+	if err != nil {
+		return V2{}, err
+	}
+	contents, err := ParseEnvelope(data, manager.String())
+	if err != nil {
+		return V2{}, err
+	}
+	if verify {
+		if err := contents.verifyOnLoad(manager.String()); err != nil {
+			return V2{}, err
+		}
+	}
+	contents.revision = revision
+	return contents, nil
+}
 
-	loader := NewVersionedLoader(envelope)
-	return loader.ReadState()
+// ParseEnvelope deserializes an envelope read from location, in any known format. Like
+// InspectEnvelope, it does not verify the envelope's MAC, but refuses an envelope whose
+// MAC was removed.
+func ParseEnvelope(data []byte, location string) (V2, error) {
+	contents, err := parseEnvelope(data, location)
+	if err != nil {
+		return V2{}, err
+	}
+	contents.unsealed = EnvelopeIntegrity != nil && (contents.Integrity == nil || !contents.Sealable())
+	return contents, nil
 }
 
 // getEnvelopePath is a helper function to get the path to the envelope file. The file
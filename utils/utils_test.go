@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -350,3 +351,61 @@ func TestGetEnvelopePathFullPath(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, tempFile, path)
 }
+
+// Updating an envelope assigns it an ID, which is kept by later writes.
+func TestUpdateEnvelope(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", t.Name())
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(tempPath)
+	tempFile := filepath.Join(tempPath, ".scuttle.json")
+
+	hush := Secret{
+		Name:       "TEST",
+		Cyphertext: "TESTCASEADDSECRET",
+		Created:    time.Now(),
+		Encoding:   "plain",
+	}
+
+	err = UpdateEnvelope(tempFile, func(envelope *V2) error {
+		assert.NotEmpty(t, envelope.ID)
+		envelope.KeyIdentifier = "/path/to/key"
+		envelope.Secrets.Add(hush)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	envelope, err := ReadEnvelope(tempFile)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, envelope.ID)
+	assert.Equal(t, "/path/to/key", envelope.KeyIdentifier)
+	assert.Len(t, envelope.Secrets, 1)
+
+	// AddSecret keeps the ID
+	hush.Name = "OTHER"
+	err = AddSecret(hush, "/path/to/key", true, tempFile)
+	assert.NoError(t, err)
+	added, err := ReadEnvelope(tempFile)
+	assert.NoError(t, err)
+	assert.Equal(t, envelope.ID, added.ID)
+	assert.Len(t, added.Secrets, 2)
+
+	// A failed update leaves the envelope untouched
+	err = UpdateEnvelope(tempFile, func(envelope *V2) error {
+		envelope.Secrets = nil
+		return errors.New("update failed")
+	})
+	assert.EqualError(t, err, "update failed")
+	unchanged, err := ReadEnvelope(tempFile)
+	assert.NoError(t, err)
+	assert.Len(t, unchanged.Secrets, 2)
+}
+
+// A missing envelope reads as empty.
+func TestReadEnvelopeMissing(t *testing.T) {
+	envelope, err := ReadEnvelope("path/does/not/exist")
+	assert.NoError(t, err)
+	assert.Empty(t, envelope.Secrets)
+	assert.Empty(t, envelope.ID)
+	assert.Equal(t, "path/does/not/exist", envelope.Filepath)
+}